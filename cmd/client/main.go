@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/markCwatson/mgrok/internal/client/proxy"
+	"github.com/markCwatson/mgrok/internal/transport"
 	"github.com/xtaci/smux"
 	"gopkg.in/yaml.v3"
 )
@@ -37,24 +41,15 @@ func main() {
 		config.Server = "localhost:9000"
 	}
 
-	log.Printf("Connecting to server at %s using TLS", config.Server)
-	var conn net.Conn
-	conn, err = tls.Dial("tcp", config.Server, &tls.Config{
-		ServerName: strings.Split(config.Server, ":")[0],
-	})
+	muxConfig, err := config.Mux.SmuxConfig()
 	if err != nil {
-		log.Printf("Failed to connect to server using TLS. Will try plain TCP.")
-		conn, err = net.Dial("tcp", config.Server)
-		if err != nil {
-			log.Fatalf("Failed to connect to server using plain TCP: %v", err)
-		}
+		log.Fatalf("Invalid mux config: %v", err)
 	}
-	defer conn.Close()
 
 	var session *smux.Session
-	session, err = smux.Client(conn, nil)
+	session, err = openSession(config, muxConfig)
 	if err != nil {
-		log.Fatalf("Failed to create smux session: %v", err)
+		log.Fatalf("Failed to connect to server: %v", err)
 	}
 	defer session.Close()
 
@@ -70,6 +65,17 @@ func main() {
 
 	proxyHandler.RegisterProxies(ctrlStream)
 
+	if err := proxyHandler.StartVisitors(); err != nil {
+		log.Fatalf("Failed to start visitors: %v", err)
+	}
+	if err := proxyHandler.StartForwards(); err != nil {
+		log.Fatalf("Failed to start forwards: %v", err)
+	}
+
+	for i := 1; i < config.PoolSize; i++ {
+		go runExtraSession(config, muxConfig, proxyHandler, session)
+	}
+
 	// Set up signal handling for clean shutdown
 	var sigChan chan os.Signal = make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -81,6 +87,96 @@ func main() {
 	log.Println("Shutting down client...")
 }
 
+// sessionRetryInterval is how long an extra session waits before reconnecting
+const sessionRetryInterval = 5 * time.Second
+
+// openSession connects to the server and starts an smux session on the connection
+func openSession(config *proxy.Config, muxConfig *smux.Config) (*smux.Session, error) {
+	conn, err := dialServer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := smux.Client(conn, muxConfig)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create smux session: %w", err)
+	}
+	return session, nil
+}
+
+// runExtraSession keeps one additional session joined to the client,
+// reconnecting when it dies, until the primary session closes
+func runExtraSession(config *proxy.Config, muxConfig *smux.Config, handler *proxy.Handler, primary *smux.Session) {
+	for !primary.IsClosed() {
+		session, err := openSession(config, muxConfig)
+		if err == nil {
+			if err = handler.JoinSession(session); err == nil {
+				log.Printf("Joined extra session to the server")
+				acceptStreams(session, handler) // returns once the session dies
+			}
+			session.Close()
+		}
+		if err != nil {
+			log.Printf("Extra session failed: %v", err)
+		}
+
+		select {
+		case <-primary.CloseChan():
+			return
+		case <-time.After(sessionRetryInterval):
+		}
+	}
+}
+
+// dialServer connects to the server with the configured transport, trying TLS
+// first and falling back to an unencrypted connection
+func dialServer(config *proxy.Config) (net.Conn, error) {
+	opts := transport.Options{
+		Addr:          config.Server,
+		TLS:           &tls.Config{ServerName: strings.Split(config.Server, ":")[0]},
+		Socket:        config.Mux.SocketConfig,
+		WebSocketPath: config.WebSocketPath,
+		KCP:           &config.KCP,
+		Noise:         &config.Noise,
+	}
+
+	// KCP runs over UDP, which HTTP and SOCKS5 proxies do not carry
+	if config.Transport != "kcp" {
+		dial, err := outboundDialer(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.Dial = dial
+	}
+
+	t, err := transport.New(config.Transport, opts)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(context.Background())
+}
+
+// outboundDialer opens connections to the server through proxy_url, or through
+// HTTPS_PROXY/ALL_PROXY when that is unset, or directly
+func outboundDialer(config *proxy.Config) (transport.DialFunc, error) {
+	var proxyURL *url.URL
+	var err error
+	if config.ProxyURL != "" {
+		proxyURL, err = url.Parse(config.ProxyURL)
+	} else {
+		proxyURL, err = transport.ProxyFromEnvironment(config.Server)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound proxy: %w", err)
+	}
+
+	if proxyURL != nil {
+		log.Printf("Connecting through proxy %s", proxyURL.Redacted())
+	}
+	return transport.ProxyDialer(proxyURL, config.Mux.SocketConfig.Dialer())
+}
+
 func loadConfig(path string) (*proxy.Config, error) {
 	var data []byte
 	var err error
@@ -94,6 +190,10 @@ func loadConfig(path string) (*proxy.Config, error) {
 		return nil, fmt.Errorf("failed to parse config: %w", err)
 	}
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
 	return &config, nil
 }
 
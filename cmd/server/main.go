@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/markCwatson/mgrok/internal/server/controller"
 	"github.com/markCwatson/mgrok/internal/server/proxy"
 	"github.com/markCwatson/mgrok/internal/server/tls"
+	"github.com/markCwatson/mgrok/internal/transport"
 	"github.com/xtaci/smux"
 )
 
@@ -31,78 +33,146 @@ func main() {
 
 	var port *int = flag.Int("port", 9000, "Port to listen on")
 	var configFile *string = flag.String("config", "configs/server.yaml", "Path to config file")
+	var genNoiseKey *bool = flag.Bool("gen-noise-key", false, "Print a new key pair for the noise transport and exit")
 	flag.Parse()
 
+	if *genNoiseKey {
+		private, public, err := transport.GenerateNoiseKey()
+		if err != nil {
+			log.Fatalf("Failed to generate noise key: %v", err)
+		}
+		fmt.Printf("private_key: %s\npublic_key: %s\n", private, public)
+		return
+	}
+
 	cfg, err = config.LoadServerConfig(*configFile)
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	controlHandler = controller.NewHandler(proxyManager, cfg)
+	proxyManager.SetAdmission(proxy.AdmissionConfig{
+		MaxStreamsPerSession: cfg.MaxStreamsPerSession,
+		AcceptRatePerIP:      cfg.AcceptRatePerIP,
+		AcceptBurstPerIP:     cfg.AcceptBurstPerIP,
+		Policy:               cfg.LimitPolicy,
+		QueueTimeout:         time.Duration(cfg.QueueTimeout) * time.Second,
+		MaxQueue:             cfg.MaxQueue,
+	})
 
-	var listener net.Listener
-	tlsManager = tls.NewManager(cfg)
-	listener, err = tlsManager.Listen(fmt.Sprintf(":%d", *port))
+	forwardAllowlist, err := proxy.NewForwardAllowlist(cfg.ForwardTargets)
 	if err != nil {
-		log.Fatalf("Failed to listen: %v", err)
+		log.Fatalf("Invalid forward_targets: %v", err)
+	}
+	proxyManager.SetForwardAllowlist(forwardAllowlist)
+
+	if cfg.StatsInterval > 0 {
+		go logStats(time.Duration(cfg.StatsInterval) * time.Second)
 	}
-	defer listener.Close()
+
+	tlsManager = tls.NewManager(cfg)
+	controlHandler = controller.NewHandler(proxyManager, tlsManager, cfg)
 
 	// signals for shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	doneChan := make(chan struct{})
 
-	go func() {
+	// The main port always takes tcp; configured listeners run alongside it
+	listenerConfigs := append([]config.ListenerConfig{{Transport: "tcp", Port: *port}}, cfg.Listeners...)
+	muxConfig, err := cfg.Mux.SmuxConfig()
+	if err != nil {
+		log.Fatalf("Invalid mux config: %v", err)
+	}
 
-		log.Printf("Server listening on :%d", *port)
+	var listeners []net.Listener
+	for _, lc := range listenerConfigs {
+		listener, err := listen(lc)
+		if err != nil {
+			log.Fatalf("Failed to listen for %s on :%d: %v", lc.Transport, lc.Port, err)
+		}
+		listeners = append(listeners, listener)
+		go acceptSessions(listener, muxConfig, doneChan)
+	}
+
+	// Wait for termination signal (SIGINT or SIGTERM)
+	<-sigChan
+	log.Println("Shutting down server due to SIGINT or SIGTERM")
+	close(doneChan)
+	cleanup(listeners)
+}
 
-		for {
-			acceptChan := make(chan net.Conn)
-			acceptErrChan := make(chan error)
+// listen opens a tunnel listener with its registered transport
+func listen(lc config.ListenerConfig) (net.Listener, error) {
+	tlsConfig := tlsManager.ListenerConfig()
+	t, err := transport.New(lc.Transport, transport.Options{
+		Addr:          net.JoinHostPort(lc.BindAddr, strconv.Itoa(lc.Port)),
+		TLS:           tlsConfig,
+		Socket:        cfg.Mux.SocketConfig,
+		WebSocketPath: lc.Path,
+		KCP:           &cfg.KCP,
+		Noise:         &cfg.Noise,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			go func() {
-				conn, err := listener.Accept()
-				if err != nil {
-					acceptErrChan <- err
-					return
-				}
-				acceptChan <- conn
-			}()
+	listener, err := t.Listen()
+	if err != nil {
+		return nil, err
+	}
+
+	security := "without TLS"
+	if lc.Transport == "noise" {
+		// Clients pin this key in noise.server_key
+		publicKey, _ := transport.NoisePublicKey(cfg.Noise.PrivateKey)
+		security = "with Noise, public key " + publicKey
+	} else if tlsConfig != nil {
+		security = "with TLS"
+	}
+	log.Printf("Server accepting %s tunnels on %s %s", lc.Transport, listener.Addr(), security)
+	return listener, nil
+}
+
+// acceptSessions accepts tunnel connections on listener and serves each one as a smux session
+func acceptSessions(listener net.Listener, muxConfig *smux.Config, doneChan chan struct{}) {
+	for {
+		acceptChan := make(chan net.Conn)
+		acceptErrChan := make(chan error)
 
-			select { // for channel operations
-			case <-doneChan:
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErrChan <- err
 				return
-			case conn := <-acceptChan:
-				log.Printf("New connection from %s", conn.RemoteAddr())
-
-				var session *smux.Session
-				session, err = smux.Server(conn, nil)
-				if err != nil {
-					log.Printf("Failed to create smux session: %v", err)
-					conn.Close()
-					continue
-				}
+			}
+			acceptChan <- conn
+		}()
+
+		select { // for channel operations
+		case <-doneChan:
+			return
+		case conn := <-acceptChan:
+			log.Printf("New connection from %s", conn.RemoteAddr())
+
+			session, err := smux.Server(conn, muxConfig)
+			if err != nil {
+				log.Printf("Failed to create smux session: %v", err)
+				conn.Close()
+				continue
+			}
 
-				go serveClient(session)
-			case err := <-acceptErrChan:
-				if err != nil {
-					select {
-					case <-doneChan:
-						return
-					default:
-						log.Printf("Failed to accept connection: %v", err)
-					}
+			go serveClient(session)
+		case err := <-acceptErrChan:
+			if err != nil {
+				select {
+				case <-doneChan:
+					return
+				default:
+					log.Printf("Failed to accept connection: %v", err)
 				}
 			}
 		}
-	}()
-
-	// Wait for termination signal (SIGINT or SIGTERM)
-	<-sigChan
-	log.Println("Shutting down server due to SIGINT or SIGTERM")
-	close(doneChan)
-	cleanup(listener)
+	}
 }
 
 func serveClient(session *smux.Session) {
@@ -124,12 +194,28 @@ func serveClient(session *smux.Session) {
 
 	go controlHandler.HandleConnection(ctrlStream, session, clientID)
 
-	// Wait for session to be done (connection-level termination)
-	<-session.CloseChan()
+	// Further streams are opened by visitors and forwards; this returns once the session is done
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		go controlHandler.HandleStream(stream, clientID)
+	}
 	log.Printf("Client %s disconnected", clientID)
 }
 
-func cleanup(listener net.Listener) {
+// periodically logs traffic counters for every proxy
+func logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		proxyManager.LogStats()
+	}
+}
+
+func cleanup(listeners []net.Listener) {
 	log.Println("Closing all proxy listeners...")
 	proxyManager.CloseAllListeners()
 
@@ -138,8 +224,10 @@ func cleanup(listener net.Listener) {
 	shutdownComplete := make(chan struct{})
 
 	go func() {
-		log.Println("Closing main listener...")
-		listener.Close()
+		log.Println("Closing main listeners...")
+		for _, listener := range listeners {
+			listener.Close()
+		}
 
 		time.Sleep(1 * time.Second)
 		close(shutdownComplete)
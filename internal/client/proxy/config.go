@@ -0,0 +1,504 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/markCwatson/mgrok/internal/transport"
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+// Config represents client configuration
+// The Proxies map in the Config struct defines the client-side proxy
+// configurations that determine which local services will be exposed through the mgrok tunnel.
+// 'yaml:"*"' are struct tags that tell the yaml package how to map the yaml file to the struct using yaml.Unmarshal()
+type Config struct {
+	Server  string                 `yaml:"server"`
+	Token   string                 `yaml:"token"`
+	Proxies map[string]ProxyConfig `yaml:"proxies"`
+
+	// How to reach the server, by registered transport name: "tcp" (TLS or plain
+	// TCP, default), "websocket" (wss:// or ws://), "kcp" (reliable UDP) or
+	// "noise" (TCP encrypted with a Noise handshake against a pinned server key)
+	Transport     string                `yaml:"transport"`
+	WebSocketPath string                `yaml:"websocket_path"` // default "/mgrok"
+	KCP           transport.KCPConfig   `yaml:"kcp"`
+	Noise         transport.NoiseConfig `yaml:"noise"`
+
+	// smux session and TCP socket tuning for the server connection
+	Mux tunnel.MuxConfig `yaml:"mux"`
+
+	// Parallel connections to the server (default 1). Data streams are spread
+	// across them, so one lossy connection does not stall every proxy.
+	PoolSize int `yaml:"pool_size"`
+
+	// Outbound proxy for reaching the server with the tcp, websocket and noise transports:
+	// http://[user:pass@]host:port, https://… (HTTP CONNECT) or socks5://[user:pass@]host:port.
+	// When unset, HTTPS_PROXY or ALL_PROXY is used, honoring NO_PROXY.
+	ProxyURL string `yaml:"proxy_url"`
+
+	// Local listeners relayed by the server to other clients' stcp proxies
+	Visitors map[string]VisitorConfig `yaml:"visitors"`
+
+	// Local listeners relayed to targets the server dials (like ssh -L)
+	Forwards map[string]ForwardConfig `yaml:"forwards"`
+
+	// Local UDP sockets idle for UDPSessionTimeout seconds are closed (default 60, max 1024 open)
+	UDPSessionTimeout int `yaml:"udp_session_timeout"`
+	MaxUDPSessions    int `yaml:"max_udp_sessions"`
+
+	// Hosts, IPs and CIDRs proxies may forward to besides the loopback
+	// address. Empty means any target is allowed.
+	AllowedTargets []string `yaml:"allowed_targets"`
+
+	allowed targetList
+}
+
+// ProxyConfig represents a single proxy entry in the client configuration
+type ProxyConfig struct {
+	Type       string   `yaml:"type"`
+	LocalIP    string   `yaml:"local_ip"` // Host, IPv4 or IPv6 address of the local service (default localhost)
+	LocalPort  int      `yaml:"local_port"`
+	LocalUnix  string   `yaml:"local_unix"` // Unix domain socket of the local service, instead of local_ip/local_port
+	RemotePort int      `yaml:"remote_port"`
+	AllowCIDRs []string `yaml:"allow_cidrs"` // Only these networks may connect (enforced by the server)
+	DenyCIDRs  []string `yaml:"deny_cidrs"`  // These networks are always dropped (enforced by the server)
+
+	// Bandwidth limit in bytes per second with an optional burst allowance (enforced by the server)
+	BandwidthLimit int `yaml:"bandwidth_limit"`
+	BandwidthBurst int `yaml:"bandwidth_burst"`
+
+	// Maximum concurrent connections forwarded for this proxy (enforced by the server)
+	MaxConnections int `yaml:"max_connections"`
+
+	// Have the server accept TLS on the public port and forward plaintext,
+	// using the named server certificate (or the server's default one)
+	TLSTermination bool   `yaml:"tls_termination"`
+	TLSCertName    string `yaml:"tls_cert_name"`
+
+	// Connect to the local service over TLS
+	LocalTLS *LocalTLSConfig `yaml:"local_tls"`
+
+	// Proxies from several clients with the same group and group_key share one
+	// remote port; new connections are spread with round_robin or least_conn
+	Group         string `yaml:"group"`
+	GroupKey      string `yaml:"group_key"`
+	GroupStrategy string `yaml:"group_strategy"`
+
+	// Check the local service periodically and withdraw the proxy while it is down
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
+
+	// Shared secret visitors must present to reach an stcp proxy
+	Secret string `yaml:"secret"`
+
+	// Settings for socks5 proxies, where the client itself serves SOCKS5
+	SOCKS5 *SOCKS5Config `yaml:"socks5"`
+
+	// Settings for static proxies, where the client itself serves files over HTTP
+	Static *StaticConfig `yaml:"static"`
+
+	// Keep this many streams open to the server in advance so new connections
+	// skip stream setup, optionally each with a local connection already dialed
+	PoolCount int  `yaml:"pool_count"`
+	PreDial   bool `yaml:"pre_dial"`
+
+	// Compress data streams between the client and the server ("deflate")
+	Compression string `yaml:"compression"`
+
+	// Encrypt data streams end to end with visitors that have the same key, so
+	// the server only relays ciphertext (stcp proxies)
+	E2EKey string `yaml:"e2e_key"`
+
+	e2e *tunnel.E2EKey
+}
+
+// VisitorConfig is a local listener whose connections reach another client's
+// stcp proxy through the server
+type VisitorConfig struct {
+	ServerName string `yaml:"server_name"` // Name the stcp proxy is registered under
+	Secret     string `yaml:"secret"`
+	BindAddr   string `yaml:"bind_addr"` // Local address to listen on (default 127.0.0.1)
+	BindPort   int    `yaml:"bind_port"`
+	E2EKey     string `yaml:"e2e_key"` // Must match the stcp proxy's e2e_key, if it has one
+
+	e2e *tunnel.E2EKey
+}
+
+// ForwardConfig is a local listener whose connections the server relays to a
+// target on its own network, if the server's forward_targets allow it
+type ForwardConfig struct {
+	Target   string `yaml:"target"`    // host:port as seen from the server
+	BindAddr string `yaml:"bind_addr"` // Local address to listen on (default 127.0.0.1)
+	BindPort int    `yaml:"bind_port"`
+}
+
+// LocalTLSConfig configures TLS between the client and a local service
+type LocalTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Accept any certificate, e.g. self-signed dev certs
+	CAFile             string `yaml:"ca_file"`              // Trust this CA instead of the system roots
+	ServerName         string `yaml:"server_name"`          // SNI and verification name override
+	CertFile           string `yaml:"cert_file"`            // Client certificate for services that require mTLS
+	KeyFile            string `yaml:"key_file"`
+
+	tlsConfig *tls.Config
+}
+
+// LocalHost returns the host of the proxy's local service without IPv6 brackets
+func (p ProxyConfig) LocalHost() string {
+	host := strings.TrimSuffix(strings.TrimPrefix(p.LocalIP, "["), "]")
+	if host == "" {
+		return "localhost"
+	}
+	return host
+}
+
+// LocalAddr returns the host:port (or socket path) of the proxy's local service
+func (p ProxyConfig) LocalAddr() string {
+	if p.LocalUnix != "" {
+		return p.LocalUnix
+	}
+	return net.JoinHostPort(p.LocalHost(), strconv.Itoa(p.LocalPort))
+}
+
+// IsPlugin reports whether the client serves the proxy itself instead of forwarding to a local service
+func (p ProxyConfig) IsPlugin() bool {
+	return p.Type == "socks5" || p.Type == "static"
+}
+
+// Validate checks the configuration and prepares derived settings such as TLS configs
+func (c *Config) Validate() error {
+	c.allowed = parseTargetList(c.AllowedTargets)
+
+	if c.Transport != "" && !transport.Registered(c.Transport) {
+		return fmt.Errorf("unknown transport %q (available: %v)", c.Transport, transport.Names())
+	}
+	if err := c.KCP.Validate(); err != nil {
+		return err
+	}
+	if err := c.Noise.Validate(); err != nil {
+		return err
+	}
+	if c.Transport == "noise" && c.Noise.ServerKey == "" {
+		return fmt.Errorf("the noise transport needs the server's public key in noise.server_key")
+	}
+	if _, err := c.Mux.SmuxConfig(); err != nil {
+		return err
+	}
+	if c.PoolSize < 0 || c.PoolSize > maxPoolSize {
+		return fmt.Errorf("pool_size must be between 1 and %d", maxPoolSize)
+	}
+	if c.ProxyURL != "" {
+		if c.Transport == "kcp" {
+			return fmt.Errorf("proxy_url cannot be used with the kcp transport")
+		}
+		u, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("unsupported proxy_url scheme %q", u.Scheme)
+		}
+	}
+	if c.WebSocketPath != "" && !strings.HasPrefix(c.WebSocketPath, "/") {
+		return fmt.Errorf("invalid websocket_path %q: must start with /", c.WebSocketPath)
+	}
+
+	for name, proxy := range c.Proxies {
+		if proxy.LocalUnix != "" {
+			if err := validateUnixTarget(proxy); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+		} else if !c.TargetAllowed(proxy.LocalHost()) {
+			return fmt.Errorf("proxy %s: local_ip %s is not in allowed_targets", name, proxy.LocalHost())
+		}
+
+		if proxy.Type == "stcp" {
+			if proxy.Secret == "" {
+				return fmt.Errorf("proxy %s: stcp proxies need a secret", name)
+			}
+			if proxy.RemotePort != 0 || proxy.Group != "" || proxy.TLSTermination {
+				return fmt.Errorf("proxy %s: stcp proxies have no remote port, group or tls_termination", name)
+			}
+		}
+
+		if proxy.IsPlugin() {
+			if proxy.LocalIP != "" || proxy.LocalPort != 0 || proxy.LocalUnix != "" || proxy.LocalTLS != nil || proxy.HealthCheck != nil {
+				return fmt.Errorf("proxy %s: %s proxies have no local service to configure", name, proxy.Type)
+			}
+		}
+
+		switch proxy.Type {
+		case "socks5":
+			if proxy.SOCKS5 == nil {
+				proxy.SOCKS5 = &SOCKS5Config{}
+				c.Proxies[name] = proxy
+			}
+			if err := proxy.SOCKS5.validate(); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+			// Otherwise anyone who finds the public port reaches everything the client can
+			if proxy.SOCKS5.Username == "" && proxy.SOCKS5.allowed.empty() && c.allowed.empty() && !proxy.SOCKS5.AllowAll {
+				return fmt.Errorf("proxy %s: a socks5 proxy without a username needs allowed_destinations, allowed_targets or allow_all", name)
+			}
+			if proxy.SOCKS5.UDP {
+				if proxy.RemotePort == 0 || proxy.Group != "" {
+					return fmt.Errorf("proxy %s: socks5 udp needs a remote_port and no group", name)
+				}
+				if _, exists := c.Proxies[socks5UDPName(name)]; exists {
+					return fmt.Errorf("proxy %s: the name %s is taken by the socks5 udp relay", socks5UDPName(name), socks5UDPName(name))
+				}
+				proxy.SOCKS5.udpPort = proxy.RemotePort
+			}
+		case "static":
+			if proxy.Static == nil {
+				return fmt.Errorf("proxy %s: static proxies need a static section with a root", name)
+			}
+			if err := proxy.Static.validate(); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+		}
+
+		if proxy.Group != "" && proxy.GroupKey == "" {
+			return fmt.Errorf("proxy %s: group %s needs a group_key", name, proxy.Group)
+		}
+		switch proxy.GroupStrategy {
+		case "", "round_robin", "least_conn":
+		default:
+			return fmt.Errorf("proxy %s: unknown group_strategy %q", name, proxy.GroupStrategy)
+		}
+
+		if proxy.HealthCheck != nil {
+			if proxy.Type == "udp" {
+				return fmt.Errorf("proxy %s: health_check is not supported for UDP proxies", name)
+			}
+			if err := proxy.HealthCheck.validate(); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+		}
+
+		if proxy.PoolCount < 0 {
+			return fmt.Errorf("proxy %s: pool_count must not be negative", name)
+		}
+		if proxy.PoolCount > 0 && proxy.Type == "udp" {
+			return fmt.Errorf("proxy %s: pool_count is not supported for UDP proxies", name)
+		}
+		if proxy.PreDial && (proxy.PoolCount == 0 || proxy.IsPlugin()) {
+			return fmt.Errorf("proxy %s: pre_dial needs a pool_count and a local service", name)
+		}
+
+		if !tunnel.ValidCompression(proxy.Compression) {
+			return fmt.Errorf("proxy %s: unknown compression %q", name, proxy.Compression)
+		}
+		if proxy.Compression != "" && proxy.Type == "udp" {
+			return fmt.Errorf("proxy %s: compression is not supported for UDP proxies", name)
+		}
+
+		if proxy.E2EKey != "" {
+			if proxy.Type != "stcp" {
+				return fmt.Errorf("proxy %s: e2e_key needs an stcp proxy; other proxies end on the server", name)
+			}
+			if proxy.Compression != "" {
+				return fmt.Errorf("proxy %s: compression has no effect on e2e encrypted streams", name)
+			}
+			proxy.e2e = tunnel.NewE2EKey(proxy.E2EKey)
+			c.Proxies[name] = proxy
+		}
+
+		if proxy.LocalTLS != nil && proxy.LocalTLS.Enabled {
+			if proxy.Type == "udp" {
+				return fmt.Errorf("proxy %s: local_tls is not supported for UDP proxies", name)
+			}
+			if err := proxy.LocalTLS.load(); err != nil {
+				return fmt.Errorf("proxy %s: %w", name, err)
+			}
+		}
+	}
+
+	for name, visitor := range c.Visitors {
+		if visitor.ServerName == "" || visitor.Secret == "" {
+			return fmt.Errorf("visitor %s: server_name and secret are required", name)
+		}
+		if visitor.BindPort <= 0 || visitor.BindPort > 65535 {
+			return fmt.Errorf("visitor %s: invalid bind_port %d", name, visitor.BindPort)
+		}
+		if visitor.E2EKey != "" {
+			visitor.e2e = tunnel.NewE2EKey(visitor.E2EKey)
+			c.Visitors[name] = visitor
+		}
+	}
+
+	for name, forward := range c.Forwards {
+		if _, _, err := net.SplitHostPort(forward.Target); err != nil {
+			return fmt.Errorf("forward %s: target must be host:port: %w", name, err)
+		}
+		if forward.BindPort <= 0 || forward.BindPort > 65535 {
+			return fmt.Errorf("forward %s: invalid bind_port %d", name, forward.BindPort)
+		}
+	}
+	return nil
+}
+
+// load builds the tls.Config used to dial the local service
+func (l *LocalTLSConfig) load() error {
+	cfg := &tls.Config{
+		InsecureSkipVerify: l.InsecureSkipVerify,
+		ServerName:         l.ServerName,
+	}
+
+	if l.CAFile != "" {
+		pem, err := os.ReadFile(l.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read local_tls ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in local_tls ca_file %s", l.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if l.CertFile != "" || l.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load local_tls client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	l.tlsConfig = cfg
+	return nil
+}
+
+// targetList is a parsed list of hostnames, IP addresses and CIDRs
+type targetList struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+func parseTargetList(entries []string) targetList {
+	t := targetList{hosts: make(map[string]bool)}
+
+	for _, target := range entries {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+
+		if _, n, err := net.ParseCIDR(target); err == nil {
+			t.nets = append(t.nets, n)
+			continue
+		}
+
+		target = strings.TrimSuffix(strings.TrimPrefix(target, "["), "]")
+		if ip := net.ParseIP(target); ip != nil {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		t.hosts[strings.ToLower(target)] = true
+	}
+	return t
+}
+
+func (t targetList) empty() bool {
+	return len(t.hosts) == 0 && len(t.nets) == 0
+}
+
+// hostListed reports whether host is listed by name
+func (t targetList) hostListed(host string) bool {
+	return t.hosts[strings.ToLower(host)]
+}
+
+// ipListed reports whether ip is in one of the listed networks
+func (t targetList) ipListed(ip net.IP) bool {
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetAllowed reports whether host is allowed by name; IP addresses are checked with IPAllowed
+func (c *Config) TargetAllowed(host string) bool {
+	if len(c.AllowedTargets) == 0 || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if c.allowed.hostListed(host) {
+		return true
+	}
+
+	// Hostnames not listed by name are resolved at dial time and checked by IP
+	if ip := net.ParseIP(host); ip != nil {
+		return c.IPAllowed(ip)
+	}
+	return len(c.allowed.nets) > 0
+}
+
+// IPAllowed reports whether ip may be dialed; loopback addresses are always allowed
+func (c *Config) IPAllowed(ip net.IP) bool {
+	return len(c.AllowedTargets) == 0 || ip.IsLoopback() || c.allowed.ipListed(ip)
+}
+
+// ResolveLocalAddr returns the address to dial for a proxy's local service. When
+// allowed_targets is set and the host is not listed by name, the host is resolved
+// and an allowed IP is returned so DNS cannot point the client somewhere else.
+func (c *Config) ResolveLocalAddr(proxy ProxyConfig) (string, error) {
+	if proxy.LocalUnix != "" {
+		return proxy.LocalUnix, nil
+	}
+
+	host := proxy.LocalHost()
+	if len(c.AllowedTargets) == 0 || strings.EqualFold(host, "localhost") || c.allowed.hostListed(host) {
+		return proxy.LocalAddr(), nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if c.IPAllowed(ip) {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(proxy.LocalPort)), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in allowed_targets", host)
+}
+
+// validateUnixTarget checks a local_unix proxy; a socket that does not exist yet
+// is only a warning since the service may start after the client
+func validateUnixTarget(proxy ProxyConfig) error {
+	if proxy.Type != "tcp" && proxy.Type != "stcp" {
+		return fmt.Errorf("local_unix is only supported for tcp and stcp proxies")
+	}
+	if proxy.LocalPort != 0 || proxy.LocalIP != "" {
+		return fmt.Errorf("local_unix cannot be combined with local_ip or local_port")
+	}
+
+	info, err := os.Stat(proxy.LocalUnix)
+	if os.IsNotExist(err) {
+		log.Printf("Warning: unix socket %s does not exist yet", proxy.LocalUnix)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access local_unix %s: %w", proxy.LocalUnix, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("local_unix %s is not a unix socket", proxy.LocalUnix)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSOCKS5Access(t *testing.T) {
+	tests := []struct {
+		name       string
+		socks5     *SOCKS5Config
+		targets    []string
+		remotePort int
+		wantErr    string
+	}{
+		{name: "open", socks5: &SOCKS5Config{}, remotePort: 1080, wantErr: "allow_all"},
+		{name: "no section", socks5: nil, remotePort: 1080, wantErr: "allow_all"},
+		{name: "allow all", socks5: &SOCKS5Config{AllowAll: true}, remotePort: 1080},
+		{name: "username", socks5: &SOCKS5Config{Username: "alice", Password: "secret"}, remotePort: 1080},
+		{name: "destinations", socks5: &SOCKS5Config{AllowedDestinations: []string{"10.0.0.0/8"}}, remotePort: 1080},
+		{name: "allowed targets", socks5: &SOCKS5Config{}, targets: []string{"127.0.0.1"}, remotePort: 1080},
+		{name: "udp without remote port", socks5: &SOCKS5Config{AllowAll: true, UDP: true}, wantErr: "remote_port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Server:         "localhost:9000",
+				AllowedTargets: tt.targets,
+				Proxies: map[string]ProxyConfig{
+					"office": {Type: "socks5", RemotePort: tt.remotePort, SOCKS5: tt.socks5},
+				},
+			}
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateLocalUnix(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "service.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	socket := ln.Addr().String()
+
+	tests := []struct {
+		name    string
+		proxy   ProxyConfig
+		wantErr string
+	}{
+		{name: "tcp", proxy: ProxyConfig{Type: "tcp", RemotePort: 8080, LocalUnix: socket}},
+		{name: "stcp", proxy: ProxyConfig{Type: "stcp", Secret: "change-me", LocalUnix: socket}},
+		{name: "udp", proxy: ProxyConfig{Type: "udp", RemotePort: 8080, LocalUnix: socket}, wantErr: "tcp and stcp"},
+		{name: "with local_port", proxy: ProxyConfig{Type: "stcp", Secret: "change-me", LocalUnix: socket, LocalPort: 5432}, wantErr: "local_port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Server:  "localhost:9000",
+				Proxies: map[string]ProxyConfig{"db": tt.proxy},
+			}
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
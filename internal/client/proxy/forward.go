@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+// StartForwards opens the local listener of every forward. Must be called after
+// RegisterProxies so the server has authenticated the session.
+func (h *Handler) StartForwards() error {
+	for name, forward := range h.config.Forwards {
+		label := fmt.Sprintf("Forward %s to %s", name, forward.Target)
+
+		addr, err := h.listenLocal(label, localBindAddress(forward.BindAddr, forward.BindPort), func(conn net.Conn) {
+			h.relay(label, conn, func(w io.Writer) error {
+				return tunnel.WriteForward(w, forward.Target)
+			}, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("forward %s: %w", name, err)
+		}
+		log.Printf("%s listening on %s", label, addr)
+	}
+	return nil
+}
@@ -1,36 +1,41 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/markCwatson/mgrok/internal/tunnel"
 	"github.com/xtaci/smux"
 )
 
+// localTLSHandshakeTimeout bounds the TLS handshake with a local service
+const localTLSHandshakeTimeout = 10 * time.Second
+
 // Handler handles client-side proxy connections
 type Handler struct {
 	session       *smux.Session
 	config        *Config
 	activeProxies map[string]*Proxy
-}
-
-// Config represents client configuration
-// The Proxies map in the Config struct defines the client-side proxy
-// configurations that determine which local services will be exposed through the mgrok tunnel.
-// 'yaml:"*"' are struct tags that tell the yaml package how to map the yaml file to the struct using yaml.Unmarshal()
-type Config struct {
-	Server  string `yaml:"server"`
-	Token   string `yaml:"token"`
-	Proxies map[string]struct {
-		Type       string `yaml:"type"`
-		LocalPort  int    `yaml:"local_port"`
-		RemotePort int    `yaml:"remote_port"`
-	} `yaml:"proxies"`
+	activeMu      sync.RWMutex
+	udpSessions   *udpSessionCache
+	socks5Assocs  *socks5Associations
+
+	// the control stream is shared with health checks, which report proxy status on it
+	ctrlStream *smux.Stream
+	ctrlMu     sync.Mutex
+
+	// With pool_size, streams are spread over several sessions joined under runID
+	runID       string
+	sessions    []*smux.Session
+	nextSession int
+	sessionsMu  sync.Mutex
 }
 
 // Proxy represents a client-side proxy
@@ -40,6 +45,12 @@ type Proxy struct {
 	LocalPort  int
 	RemotePort int
 	LocalConn  net.Conn
+
+	// Compression the server confirmed for data streams (empty means none)
+	Compression string
+
+	ready    chan struct{} // Closed once the server has answered the registration
+	accepted bool
 }
 
 // NewHandler creates a new proxy handler
@@ -48,6 +59,12 @@ func NewHandler(session *smux.Session, config *Config) *Handler {
 		session:       session,
 		config:        config,
 		activeProxies: make(map[string]*Proxy),
+		sessions:      []*smux.Session{session},
+		udpSessions: newUDPSessionCache(
+			time.Duration(config.UDPSessionTimeout)*time.Second,
+			config.MaxUDPSessions,
+		),
+		socks5Assocs: newSOCKS5Associations(),
 	}
 }
 
@@ -55,14 +72,26 @@ func NewHandler(session *smux.Session, config *Config) *Handler {
 func (h *Handler) RegisterProxies(stream *smux.Stream) {
 	log.Println("Registering proxies...")
 
+	h.ctrlStream = stream
+
 	// Write the protocol handshake
 	if err := tunnel.WriteHandshake(stream, tunnel.AuthMethodToken, []byte(h.config.Token)); err != nil {
 		log.Printf("Failed to write handshake: %v", err)
 		return
 	}
 
-	// Wait a moment to ensure the server processes the handshake
-	time.Sleep(100 * time.Millisecond)
+	// Let further sessions join this one
+	if h.config.PoolSize > 1 {
+		runID, err := newRunID()
+		if err == nil {
+			err = join(stream, tunnel.JoinPrimary, runID)
+		}
+		if err != nil {
+			log.Printf("Failed to start session pool: %v", err)
+		} else {
+			h.runID = runID
+		}
+	}
 
 	// Register each proxy in the config
 	for name, proxy := range h.config.Proxies {
@@ -71,43 +100,199 @@ func (h *Handler) RegisterProxies(stream *smux.Stream) {
 		var proxyType uint8
 
 		switch proxy.Type {
-		case "tcp":
+		case "tcp", "socks5", "static":
 			proxyType = tunnel.ProxyTypeTCP
 		case "udp":
 			proxyType = tunnel.ProxyTypeUDP
+		case "stcp":
+			proxyType = tunnel.ProxyTypeSTCP
 		default:
 			log.Printf("Unknown proxy type for %s: %s", name, proxy.Type)
 			continue
 		}
 
-		// Send registration message
-		err := tunnel.WriteRegister(
-			stream,
-			proxyType,
-			uint16(proxy.RemotePort),
-			uint16(proxy.LocalPort),
-			name,
-		)
+		if !h.registerProxy(stream, name, proxyType, proxy) {
+			continue
+		}
+
+		// The UDP side of a socks5 proxy is a UDP proxy on the same port number
+		if proxy.Type == "socks5" && proxy.SOCKS5.UDP {
+			udp := proxy
+			udp.Compression, udp.TLSTermination, udp.PoolCount = "", false, 0
+			h.registerProxy(stream, socks5UDPName(name), tunnel.ProxyTypeUDP, udp)
+		}
+	}
+
+	// Start health checks and stream pools once every proxy is registered
+	for name, proxy := range h.config.Proxies {
+		if h.activeProxy(name) == nil {
+			continue
+		}
+		if proxy.HealthCheck != nil {
+			go h.runHealthCheck(name, proxy)
+		}
+		for i := 0; i < proxy.PoolCount; i++ {
+			go h.runStreamPool(name, proxy)
+		}
+	}
+
+	go h.watchControl(stream)
+}
+
+// registerProxy registers one proxy and waits for the server's reply
+func (h *Handler) registerProxy(stream *smux.Stream, name string, proxyType uint8, proxy ProxyConfig) bool {
+	// Streams for the proxy may arrive before its reply is read; they wait on ready
+	active := &Proxy{
+		Name:       name,
+		Type:       proxy.Type,
+		LocalPort:  proxy.LocalPort,
+		RemotePort: proxy.RemotePort,
+		ready:      make(chan struct{}),
+	}
+	h.activeMu.Lock()
+	h.activeProxies[name] = active
+	h.activeMu.Unlock()
+
+	// Send registration message
+	err := tunnel.WriteRegister(stream, &tunnel.RegisterMsg{
+		ProxyType:  proxyType,
+		RemotePort: uint16(proxy.RemotePort),
+		LocalPort:  uint16(proxy.LocalPort),
+		Name:       name,
+		AllowCIDRs: proxy.AllowCIDRs,
+		DenyCIDRs:  proxy.DenyCIDRs,
+
+		BandwidthLimit: uint32(proxy.BandwidthLimit),
+		BandwidthBurst: uint32(proxy.BandwidthBurst),
+		MaxConns:       uint32(proxy.MaxConnections),
+		TLSTermination: proxy.TLSTermination,
+		TLSCertName:    proxy.TLSCertName,
+		Group:          proxy.Group,
+		GroupKey:       proxy.GroupKey,
+		GroupStrategy:  proxy.GroupStrategy,
+		Secret:         proxy.Secret,
+		PoolCount:      uint32(proxy.PoolCount),
+		Compression:    proxy.Compression,
+		PeerAddr:       proxy.Type == "socks5" && proxy.SOCKS5.UDP,
+	})
+
+	var reply *tunnel.RegisterReplyMsg
+	if err == nil {
+		reply, err = h.readRegisterReply(stream, name)
+	}
+	if err == nil && reply.Reply != tunnel.ReplyOK {
+		err = fmt.Errorf("refused by server: %s", reply.Error)
+	}
+	if err != nil {
+		log.Printf("Failed to register proxy %s: %v", name, err)
+		h.activeMu.Lock()
+		delete(h.activeProxies, name)
+		h.activeMu.Unlock()
+		close(active.ready)
+		return false
+	}
 
+	if reply.Compression != proxy.Compression {
+		log.Printf("Server did not accept compression %q for proxy %s; sending data uncompressed",
+			proxy.Compression, name)
+	}
+	active.Compression = reply.Compression
+	active.accepted = true
+	close(active.ready)
+
+	log.Printf("Registered proxy %s: %s port %d -> %d",
+		name, proxy.Type, proxy.LocalPort, proxy.RemotePort)
+	return true
+}
+
+// replyTimeout bounds how long the client waits for the server to answer a register or join message
+const replyTimeout = 10 * time.Second
+
+// readRegisterReply waits for the server's answer to the registration of the named proxy
+func (h *Handler) readRegisterReply(stream *smux.Stream, name string) (*tunnel.RegisterReplyMsg, error) {
+	stream.SetReadDeadline(time.Now().Add(replyTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	for {
+		msg, err := tunnel.ReadControl(stream)
 		if err != nil {
-			log.Printf("Failed to register proxy %s: %v", name, err)
+			return nil, fmt.Errorf("failed to read register reply: %w", err)
+		}
+
+		// The server may remove a proxy registered earlier while replies are pending
+		if msg[0] == tunnel.MsgTypeStatus {
+			h.handleStatusMsg(msg[1:])
 			continue
 		}
+		if msg[0] != tunnel.MsgTypeRegReply {
+			return nil, fmt.Errorf("expected register reply, got message type 0x%02x", msg[0])
+		}
+
+		reply, err := tunnel.ParseRegisterReply(msg[1:])
+		if err != nil {
+			return nil, err
+		}
+		if reply.Name != name {
+			return nil, fmt.Errorf("got reply for proxy %s instead", reply.Name)
+		}
+		return reply, nil
+	}
+}
 
-		// Store the active proxy
-		h.activeProxies[name] = &Proxy{
-			Name:       name,
-			Type:       proxy.Type,
-			LocalPort:  proxy.LocalPort,
-			RemotePort: proxy.RemotePort,
+// watchControl reads what the server sends on the control stream once every
+// proxy is registered, until the stream closes
+func (h *Handler) watchControl(stream *smux.Stream) {
+	for {
+		msg, err := tunnel.ReadControl(stream)
+		if err != nil {
+			return
 		}
 
-		log.Printf("Registered proxy %s: %s port %d -> %d",
-			name, proxy.Type, proxy.LocalPort, proxy.RemotePort)
+		switch msg[0] {
+		case tunnel.MsgTypeStatus:
+			h.handleStatusMsg(msg[1:])
+		case tunnel.MsgTypeHeartbeat:
+			// Nothing to do: the stream is alive
+		default:
+			log.Printf("Unknown message type on control stream: 0x%02x", msg[0])
+		}
+	}
+}
 
-		// Wait a moment between registrations to prevent messages from blending together
-		time.Sleep(100 * time.Millisecond)
+// handleStatusMsg handles a proxy status sent by the server
+func (h *Handler) handleStatusMsg(data []byte) {
+	msg, err := tunnel.ParseStatus(data)
+	if err != nil {
+		log.Printf("Invalid status message: %v", err)
+		return
+	}
+	if msg.Status != tunnel.StatusRemoved {
+		log.Printf("Unexpected status %d for proxy %s", msg.Status, msg.Name)
+		return
 	}
+
+	// Pools and health checks stop once the proxy is no longer active
+	h.activeMu.Lock()
+	delete(h.activeProxies, msg.Name)
+	h.activeMu.Unlock()
+	log.Printf("Server removed proxy %s; it no longer receives connections", msg.Name)
+}
+
+// activeProxy returns a proxy the server accepted, or nil. If the server's
+// reply is still outstanding it waits for it.
+func (h *Handler) activeProxy(name string) *Proxy {
+	h.activeMu.RLock()
+	active := h.activeProxies[name]
+	h.activeMu.RUnlock()
+
+	if active == nil {
+		return nil
+	}
+	<-active.ready
+	if !active.accepted {
+		return nil
+	}
+	return active
 }
 
 // HandleStream handles an incoming stream from the server
@@ -125,7 +310,7 @@ func (h *Handler) HandleStream(stream *smux.Stream) {
 
 	// Check if this is a NewStream message
 	if msgType == tunnel.MsgTypeNewStream {
-		h.handleNewStream(stream)
+		h.handleNewStream(stream, nil)
 		return
 	}
 
@@ -134,8 +319,15 @@ func (h *Handler) HandleStream(stream *smux.Stream) {
 	io.Copy(io.Discard, stream)
 }
 
-// handleNewStream handles a new stream request from the server
-func (h *Handler) handleNewStream(stream *smux.Stream) {
+// handleNewStream handles a new stream request from the server. localConn, if
+// set, is a connection to the local service dialed in advance for a pooled stream.
+func (h *Handler) handleNewStream(stream *smux.Stream, localConn net.Conn) {
+	defer func() {
+		if localConn != nil {
+			localConn.Close()
+		}
+	}()
+
 	// Read the message header first (just streamID)
 	streamIDBuf := make([]byte, 4)
 	if _, err := io.ReadFull(stream, streamIDBuf); err != nil {
@@ -168,29 +360,40 @@ func (h *Handler) handleNewStream(stream *smux.Stream) {
 	log.Printf("New stream request for ID %d, proxy: %s, remote port: %d",
 		streamID, proxyName, remotePort)
 
-	// Find the matching local port for this proxy
-	var localPort int
+	// Find the matching proxy config
+	var proxyCfg ProxyConfig
 	var proxyFound bool
-	var proxyType string
 
 	// First try to find by name
 	if proxyName != "" {
 		if proxy, exists := h.config.Proxies[proxyName]; exists {
-			localPort = proxy.LocalPort
-			proxyType = proxy.Type
+			proxyCfg = proxy
 			proxyFound = true
-			log.Printf("Found proxy by name: %s -> localhost:%d", proxyName, localPort)
+			log.Printf("Found proxy by name: %s -> %s", proxyName, proxy.LocalAddr())
+		}
+	}
+
+	// The UDP side of a socks5 proxy shares the socks5 proxy's config
+	var socks5UDP bool
+	if !proxyFound {
+		if base, ok := strings.CutSuffix(proxyName, "/udp"); ok {
+			if proxy, exists := h.config.Proxies[base]; exists && proxy.Type == "socks5" && proxy.SOCKS5.UDP {
+				proxyCfg = proxy
+				proxyName = base
+				proxyFound = true
+				socks5UDP = true
+			}
 		}
 	}
 
 	// Fallback to finding by remote port if name lookup failed
 	if !proxyFound {
-		for _, proxy := range h.config.Proxies {
+		for name, proxy := range h.config.Proxies {
 			if proxy.RemotePort == int(remotePort) {
-				localPort = proxy.LocalPort
-				proxyType = proxy.Type
+				proxyCfg = proxy
+				proxyName = name
 				proxyFound = true
-				log.Printf("Found proxy by port: %d -> localhost:%d", remotePort, localPort)
+				log.Printf("Found proxy by port: %d -> %s", remotePort, proxy.LocalAddr())
 				break
 			}
 		}
@@ -205,91 +408,89 @@ func (h *Handler) handleNewStream(stream *smux.Stream) {
 		}
 
 		log.Printf("Warning: Could not find matching proxy, using first available")
-		for _, proxy := range h.config.Proxies {
-			localPort = proxy.LocalPort
-			proxyType = proxy.Type
+		for name, proxy := range h.config.Proxies {
+			proxyCfg = proxy
+			proxyName = name
 			break
 		}
 	}
 
-	localAddr := fmt.Sprintf("localhost:%d", localPort)
-	log.Printf("Connecting to local %s service at %s for stream %d", proxyType, localAddr, streamID)
-
-	if proxyType == "udp" {
-		// udp
-		udpAddr, err := net.ResolveUDPAddr("udp", localAddr)
-		if err != nil {
-			log.Printf("Failed to resolve UDP address %s: %v", localAddr, err)
-			stream.Close()
+	// Proxies that serve SOCKS5 UDP are told who the public peer is
+	var peer string
+	if proxyCfg.Type == "socks5" && proxyCfg.SOCKS5.UDP {
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+			log.Printf("Failed to read peer address: %v", err)
 			return
 		}
-		udpConn, err := net.DialUDP("udp", nil, udpAddr)
-		if err != nil {
-			log.Printf("Failed to dial UDP %s: %v", localAddr, err)
-			stream.Close()
+		peerBuf := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(stream, peerBuf); err != nil {
+			log.Printf("Failed to read peer address: %v", err)
 			return
 		}
-		defer udpConn.Close()
+		peer = string(peerBuf)
+	}
 
-		errCh := make(chan error, 2)
+	if socks5UDP {
+		h.serveSOCKS5UDP(stream, proxyName, proxyCfg.SOCKS5, peer)
+		log.Printf("Stream %d closed", streamID)
+		return
+	}
 
-		// bidirectional UDP forwarding
-		// to local udp service
-		go func() {
-			buf := make([]byte, 65535)
-			for {
-				n, err := udpConn.Read(buf)
-				if err != nil {
-					errCh <- err
-					return
-				}
-				lenBuf := make([]byte, 2)
-				binary.BigEndian.PutUint16(lenBuf, uint16(n))
-				if _, err := stream.Write(lenBuf); err != nil {
-					errCh <- err
-					return
-				}
-				if _, err := stream.Write(buf[:n]); err != nil {
-					errCh <- err
-					return
-				}
-			}
-		}()
+	// Compression starts after the NewStream header, if the server accepted it
+	var conn net.Conn = stream
+	if active := h.activeProxy(proxyName); active != nil && active.Compression != "" {
+		var err error
+		if conn, err = tunnel.Compress(stream, active.Compression); err != nil {
+			log.Printf("Failed to compress stream %d: %v", streamID, err)
+			return
+		}
+		defer conn.Close()
+	}
 
-		// to server on udp port
-		go func() {
-			for {
-				lenBuf := make([]byte, 2)
-				if _, err := io.ReadFull(stream, lenBuf); err != nil {
-					errCh <- err
-					return
-				}
-				l := binary.BigEndian.Uint16(lenBuf)
-				data := make([]byte, l)
-				if _, err := io.ReadFull(stream, data); err != nil {
-					errCh <- err
-					return
-				}
-				if _, err := udpConn.Write(data); err != nil {
-					errCh <- err
-					return
-				}
-			}
-		}()
+	// Only the visitor at the other end can read what an e2e proxy sends
+	if proxyCfg.e2e != nil {
+		sealed, err := tunnel.Seal(conn, proxyCfg.e2e)
+		if err != nil {
+			log.Printf("Failed to start e2e encryption on stream %d: %v", streamID, err)
+			return
+		}
+		defer sealed.Close()
+		conn = sealed
+	}
 
-		err = <-errCh
-		if err != nil && err != io.EOF {
-			log.Printf("UDP forwarding error: %v", err)
+	// Plugins serve the stream themselves instead of dialing a local service
+	if proxyCfg.IsPlugin() {
+		switch proxyCfg.Type {
+		case "socks5":
+			h.serveSOCKS5(conn, proxyName, proxyCfg.SOCKS5, peer)
+		case "static":
+			serveStatic(conn, proxyName, proxyCfg.Static)
 		}
+		log.Printf("Stream %d closed", streamID)
+		return
+	}
+
+	localAddr, err := h.config.ResolveLocalAddr(proxyCfg)
+	if err != nil {
+		log.Printf("Refusing to connect stream %d to %s: %v", streamID, proxyCfg.LocalAddr(), err)
+		stream.Close()
+		return
+	}
+	log.Printf("Connecting to local %s service at %s for stream %d", proxyCfg.Type, localAddr, streamID)
+
+	if proxyCfg.Type == "udp" {
+		h.forwardUDP(stream, streamID, localAddr)
 	} else {
-		// tcp
-		localConn, err := net.Dial("tcp", localAddr)
-		if err != nil {
-			log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
-			stream.Close()
-			return
+		// tcp and stcp
+		if localConn == nil {
+			localConn, err = dialLocal(proxyCfg, localAddr)
+			if err != nil {
+				log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
+				stream.Close()
+				return
+			}
 		}
-		defer localConn.Close()
 
 		errCh := make(chan error, 2)
 
@@ -297,13 +498,13 @@ func (h *Handler) handleNewStream(stream *smux.Stream) {
 
 		// to local tcp service
 		go func() {
-			_, err := io.Copy(stream, localConn)
+			_, err := io.Copy(conn, localConn)
 			errCh <- err
 		}()
 
 		// to server on tcp port
 		go func() {
-			_, err := io.Copy(localConn, stream)
+			_, err := io.Copy(localConn, conn)
 			errCh <- err
 		}()
 
@@ -315,3 +516,35 @@ func (h *Handler) handleNewStream(stream *smux.Stream) {
 
 	log.Printf("Stream %d closed", streamID)
 }
+
+// dialLocal connects to the local TCP or unix socket service of a proxy, wrapping it in TLS if configured
+func dialLocal(proxy ProxyConfig, localAddr string) (net.Conn, error) {
+	network := "tcp"
+	if proxy.LocalUnix != "" {
+		network = "unix"
+	}
+
+	conn, err := net.Dial(network, localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxy.LocalTLS == nil || !proxy.LocalTLS.Enabled {
+		return conn, nil
+	}
+
+	cfg := proxy.LocalTLS.tlsConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = proxy.LocalHost()
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(localTLSHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with local service failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
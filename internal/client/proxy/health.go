@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+const (
+	defaultHealthInterval    = 10 * time.Second
+	defaultHealthTimeout     = 3 * time.Second
+	defaultHealthMaxFailures = 3
+)
+
+// HealthCheckConfig configures periodic checks of a proxy's local service
+type HealthCheckConfig struct {
+	Type        string `yaml:"type"`         // "tcp" (connect) or "http" (GET)
+	Path        string `yaml:"path"`         // Request path for http checks (default "/")
+	Interval    int    `yaml:"interval"`     // Seconds between checks (default 10)
+	Timeout     int    `yaml:"timeout"`      // Seconds before a check fails (default 3)
+	MaxFailures int    `yaml:"max_failures"` // Consecutive failures before the proxy is withdrawn (default 3)
+}
+
+func (c *HealthCheckConfig) validate() error {
+	switch c.Type {
+	case "tcp", "http":
+	default:
+		return fmt.Errorf("unknown health_check type %q", c.Type)
+	}
+	if c.Interval < 0 || c.Timeout < 0 || c.MaxFailures < 0 {
+		return fmt.Errorf("health_check values must not be negative")
+	}
+	return nil
+}
+
+// runHealthCheck checks a proxy's local service until the session closes or the
+// server removes the proxy, and reports each change between healthy and unhealthy to the server
+func (h *Handler) runHealthCheck(name string, proxy ProxyConfig) {
+	hc := proxy.HealthCheck
+	interval := time.Duration(hc.Interval) * time.Second
+	if interval == 0 {
+		interval = defaultHealthInterval
+	}
+	timeout := time.Duration(hc.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	maxFailures := hc.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = defaultHealthMaxFailures
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The server starts out treating the proxy as healthy, so check right away
+	healthy := true
+	passed := false // Whether any check has succeeded yet
+	failures := 0
+	for {
+		err := h.checkHealth(proxy, timeout)
+		if err == nil {
+			passed = true
+			failures = 0
+			if !healthy {
+				healthy = true
+				log.Printf("Health check for proxy %s recovered", name)
+				h.sendStatus(name, tunnel.StatusHealthy)
+			}
+		} else {
+			failures++
+			log.Printf("Health check for proxy %s failed (%d/%d): %v", name, failures, maxFailures, err)
+			// A service that has never passed a check is withdrawn without waiting for more failures
+			if healthy && (failures >= maxFailures || !passed) {
+				healthy = false
+				log.Printf("Proxy %s is unhealthy, withdrawing it", name)
+				h.sendStatus(name, tunnel.StatusUnhealthy)
+			}
+		}
+
+		select {
+		case <-h.session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+		if h.activeProxy(name) == nil {
+			return
+		}
+	}
+}
+
+// checkHealth runs a single check against the proxy's local service
+func (h *Handler) checkHealth(proxy ProxyConfig, timeout time.Duration) error {
+	addr, err := h.config.ResolveLocalAddr(proxy)
+	if err != nil {
+		return err
+	}
+
+	network := "tcp"
+	if proxy.LocalUnix != "" {
+		network = "unix"
+	}
+
+	if proxy.HealthCheck.Type == "tcp" {
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// http: always dial the resolved local address, whatever the URL host is
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		DisableKeepAlives: true,
+	}
+	scheme := "http"
+	if proxy.LocalTLS != nil && proxy.LocalTLS.Enabled {
+		scheme = "https"
+		transport.TLSClientConfig = proxy.LocalTLS.tlsConfig
+	}
+
+	path := proxy.HealthCheck.Path
+	if path == "" {
+		path = "/"
+	}
+
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	host := net.JoinHostPort(proxy.LocalHost(), strconv.Itoa(proxy.LocalPort))
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", scheme, host, path))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sendStatus reports a proxy's health to the server over the control stream
+func (h *Handler) sendStatus(name string, status uint8) {
+	h.ctrlMu.Lock()
+	defer h.ctrlMu.Unlock()
+
+	if err := tunnel.WriteStatus(h.ctrlStream, name, status); err != nil {
+		log.Printf("Failed to send status for proxy %s: %v", name, err)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+// localBindAddress returns the host:port a local listener binds to; host defaults to 127.0.0.1
+func localBindAddress(host string, port int) string {
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// listenLocal opens a local listener, closed along with the session, and hands each connection to handle
+func (h *Handler) listenLocal(label, addr string, handle func(net.Conn)) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-h.session.CloseChan()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("%s listener closed: %v", label, err)
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return listener.Addr(), nil
+}
+
+// relay opens a stream, sends the request written by request and, once the
+// server accepts it, forwards conn over the stream, end-to-end encrypted if e2e is set
+func (h *Handler) relay(label string, conn net.Conn, request func(io.Writer) error, e2e *tunnel.E2EKey) {
+	defer conn.Close()
+
+	stream, err := h.openStream()
+	if err != nil {
+		log.Printf("%s failed to open stream: %v", label, err)
+		return
+	}
+	defer stream.Close()
+
+	if err := request(stream); err != nil {
+		log.Printf("%s: %v", label, err)
+		return
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(stream, reply); err != nil {
+		log.Printf("%s got no answer from the server: %v", label, err)
+		return
+	}
+	switch reply[0] {
+	case tunnel.ReplyOK:
+	case tunnel.ReplyDenied:
+		log.Printf("%s denied by the server", label)
+		return
+	default:
+		log.Printf("%s failed on the server", label)
+		return
+	}
+
+	var tunnelConn net.Conn = stream
+	if e2e != nil {
+		sealed, err := tunnel.Seal(stream, e2e)
+		if err != nil {
+			log.Printf("%s failed to start e2e encryption: %v", label, err)
+			return
+		}
+		defer sealed.Close()
+		tunnelConn = sealed
+	}
+
+	log.Printf("%s connected %s", label, conn.RemoteAddr())
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(tunnelConn, conn)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, tunnelConn)
+		errCh <- err
+	}()
+
+	if err := <-errCh; err != nil && err != io.EOF {
+		log.Printf("Error in %s forwarding: %v", label, err)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+const (
+	// A pool slot whose stream the server refused or lost waits before reopening it,
+	// doubling the wait up to poolMaxRetryInterval while the server keeps refusing
+	poolRetryInterval    = 5 * time.Second
+	poolMaxRetryInterval = 2 * time.Minute
+
+	// preDialMaxIdle is how long a pre-dialed local connection may sit unused
+	// before it is replaced, so local services never see it time out
+	preDialMaxIdle = 15 * time.Second
+)
+
+// runStreamPool keeps one pre-opened stream for the proxy until the session closes
+// or the server removes the proxy. A used stream is served in the background so
+// the slot is refilled right away.
+func (h *Handler) runStreamPool(name string, proxy ProxyConfig) {
+	retry := poolRetryInterval
+	for !h.session.IsClosed() && h.activeProxy(name) != nil {
+		if h.serveWorkStream(name, proxy) {
+			retry = poolRetryInterval
+			continue
+		}
+
+		time.Sleep(retry)
+		retry = min(retry*2, poolMaxRetryInterval)
+	}
+}
+
+// serveWorkStream opens a stream, offers it to the server for the proxy and
+// starts serving it once the server sends NewStream on it. It reports whether the stream was used.
+func (h *Handler) serveWorkStream(name string, proxy ProxyConfig) bool {
+	stream, err := h.openStream()
+	if err != nil {
+		return false
+	}
+
+	if err := tunnel.WriteWorkConn(stream, name); err != nil {
+		log.Printf("Failed to offer work stream for proxy %s: %v", name, err)
+		stream.Close()
+		return false
+	}
+
+	var localConn net.Conn
+	msgTypeBuf := make([]byte, 1)
+	for {
+		if proxy.PreDial && localConn == nil {
+			localConn = h.preDial(name, proxy)
+		}
+		if localConn != nil {
+			stream.SetReadDeadline(time.Now().Add(preDialMaxIdle))
+		}
+
+		_, err = stream.Read(msgTypeBuf)
+		if err == nil {
+			break
+		}
+		if localConn != nil {
+			localConn.Close()
+			localConn = nil
+		}
+		if !errors.Is(err, smux.ErrTimeout) {
+			// Closed by the server (pool full, proxy gone) or the session ended
+			stream.Close()
+			return false
+		}
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	if msgTypeBuf[0] != tunnel.MsgTypeNewStream {
+		log.Printf("Received unknown message type on work stream %d: %d", stream.ID(), msgTypeBuf[0])
+		if localConn != nil {
+			localConn.Close()
+		}
+		stream.Close()
+		return false
+	}
+
+	go func() {
+		defer stream.Close()
+		h.handleNewStream(stream, localConn)
+	}()
+	return true
+}
+
+// preDial connects to the proxy's local service ahead of time; nil means it will be dialed on use
+func (h *Handler) preDial(name string, proxy ProxyConfig) net.Conn {
+	localAddr, err := h.config.ResolveLocalAddr(proxy)
+	if err != nil {
+		return nil
+	}
+
+	conn, err := dialLocal(proxy, localAddr)
+	if err != nil {
+		log.Printf("Failed to pre-dial local service for proxy %s: %v", name, err)
+		return nil
+	}
+	return conn
+}
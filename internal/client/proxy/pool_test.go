@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// acceptWorkStream plays the server: it waits for the client to offer a work stream
+func acceptWorkStream(t *testing.T, server *smux.Session, name string) *smux.Stream {
+	t.Helper()
+
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	defer server.SetDeadline(time.Time{})
+
+	stream, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("no work stream offered: %v", err)
+	}
+	msgType := make([]byte, 1)
+	if _, err := io.ReadFull(stream, msgType); err != nil {
+		t.Fatal(err)
+	}
+	if msgType[0] != tunnel.MsgTypeWorkConn {
+		t.Fatalf("got message type 0x%02x, want 0x%02x", msgType[0], tunnel.MsgTypeWorkConn)
+	}
+	got, err := tunnel.ReadWorkConn(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != name {
+		t.Fatalf("work stream offered for %q, want %q", got, name)
+	}
+	return stream
+}
+
+func TestStreamPoolRefillsWhileConnectionIsOpen(t *testing.T) {
+	// A local service that keeps every connection open
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	client, server := smuxPair(t)
+	proxy := ProxyConfig{Type: "tcp", LocalIP: "127.0.0.1", LocalPort: ln.Addr().(*net.TCPAddr).Port}
+	h := NewHandler(client, &Config{Proxies: map[string]ProxyConfig{"web": proxy}})
+	ready := make(chan struct{})
+	close(ready)
+	h.activeProxies["web"] = &Proxy{Name: "web", Type: "tcp", ready: ready, accepted: true}
+	go h.runStreamPool("web", proxy)
+
+	// A user connects: the server sends NewStream on the pooled stream
+	first := acceptWorkStream(t, server, "web")
+	header := []byte{tunnel.MsgTypeNewStream, 0, 0, 0, 0, 0, 0, 3, 'w', 'e', 'b'}
+	binary.BigEndian.PutUint32(header[1:5], first.ID())
+	if _, err := first.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	var local net.Conn
+	select {
+	case local = <-accepted:
+		defer local.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("pooled stream was not connected to the local service")
+	}
+
+	// The slot is reopened while that connection is still in use
+	acceptWorkStream(t, server, "web")
+
+	if _, err := first.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(local, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("first connection no longer forwards: %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// maxPoolSize caps the parallel connections a client opens to the server
+const maxPoolSize = 16
+
+// newRunID returns the random ID that ties this client's sessions together on the server
+func newRunID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// JoinSession authenticates an additional session and joins it to this client
+// on the server, which then spreads data streams across all sessions. Must be
+// called after RegisterProxies.
+func (h *Handler) JoinSession(session *smux.Session) error {
+	if h.runID == "" {
+		return fmt.Errorf("the primary session did not start a session pool")
+	}
+
+	ctrlStream, err := session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("failed to open control stream: %w", err)
+	}
+	if err := tunnel.WriteHandshake(ctrlStream, tunnel.AuthMethodToken, []byte(h.config.Token)); err != nil {
+		return err
+	}
+
+	// Streams are only striped onto the session once the server has accepted it
+	if err := join(ctrlStream, tunnel.JoinMember, h.runID); err != nil {
+		return err
+	}
+
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+
+	live := []*smux.Session{session}
+	for _, s := range h.sessions {
+		if !s.IsClosed() {
+			live = append(live, s)
+		}
+	}
+	h.sessions = live
+	return nil
+}
+
+// join sends a join message on a control stream and waits for the server's answer
+func join(ctrlStream *smux.Stream, role uint8, runID string) error {
+	if err := tunnel.WriteJoin(ctrlStream, role, runID); err != nil {
+		return err
+	}
+
+	ctrlStream.SetReadDeadline(time.Now().Add(replyTimeout))
+	defer ctrlStream.SetReadDeadline(time.Time{})
+
+	reply, err := tunnel.ReadJoinReply(ctrlStream)
+	if err != nil {
+		return err
+	}
+	if reply.Reply != tunnel.ReplyOK {
+		return fmt.Errorf("refused by server: %s", reply.Error)
+	}
+	return nil
+}
+
+// openStream opens a stream to the server, spreading streams across the
+// client's sessions and skipping sessions that have died
+func (h *Handler) openStream() (*smux.Stream, error) {
+	h.sessionsMu.Lock()
+	sessions := append([]*smux.Session{}, h.sessions...)
+	start := h.nextSession
+	h.nextSession++
+	h.sessionsMu.Unlock()
+
+	lastErr := fmt.Errorf("no open session to the server")
+	for i := range sessions {
+		session := sessions[(start+i)%len(sessions)]
+		if session.IsClosed() {
+			continue
+		}
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
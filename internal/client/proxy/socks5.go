@@ -0,0 +1,621 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929)
+const (
+	socks5Version     = 0x05
+	socks5AuthVersion = 0x01
+
+	socks5MethodNone         = 0x00
+	socks5MethodPassword     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded        = 0x00
+	socks5RepGeneralFailure   = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepNetUnreachable   = 0x03
+	socks5RepHostUnreachable  = 0x04
+	socks5RepConnRefused      = 0x05
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+)
+
+const (
+	// socks5HandshakeTimeout bounds authentication and the request on a new stream
+	socks5HandshakeTimeout = 30 * time.Second
+	// socks5DialTimeout bounds how long a CONNECT waits for the destination
+	socks5DialTimeout = 10 * time.Second
+)
+
+// SOCKS5Config configures the SOCKS5 server the client runs for a socks5 proxy
+type SOCKS5Config struct {
+	Username string `yaml:"username"` // Require username/password auth when set
+	Password string `yaml:"password"`
+
+	// Hosts, IPs and CIDRs that may be reached; allowed_targets applies as well.
+	// Without a username or a destination list AllowAll must be set explicitly.
+	AllowedDestinations []string `yaml:"allowed_destinations"`
+	AllowAll            bool     `yaml:"allow_all"`
+
+	// Serve UDP ASSOCIATE: the server relays datagrams sent to remote_port over
+	// UDP through the tunnel. UDPHost is the address announced to SOCKS clients
+	// for it (default the host of the server address).
+	UDP     bool   `yaml:"udp"`
+	UDPHost string `yaml:"udp_host"`
+
+	allowed targetList
+	udpPort int
+}
+
+func (c *SOCKS5Config) validate() error {
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("socks5 password needs a username")
+	}
+	if len(c.Username) > 255 || len(c.Password) > 255 {
+		return fmt.Errorf("socks5 username and password must be at most 255 bytes")
+	}
+	if len(c.UDPHost) > 255 {
+		return fmt.Errorf("socks5 udp_host must be at most 255 bytes")
+	}
+
+	c.allowed = parseTargetList(c.AllowedDestinations)
+	return nil
+}
+
+// socks5Request is a parsed SOCKS5 request
+type socks5Request struct {
+	cmd  byte
+	host string
+	port int
+}
+
+// serveSOCKS5 runs one SOCKS5 session on a stream from the server; peer is the
+// SOCKS client's address as seen by the server, sent for proxies that serve UDP
+func (h *Handler) serveSOCKS5(conn net.Conn, name string, cfg *SOCKS5Config, peer string) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	if err := socks5Authenticate(conn, cfg); err != nil {
+		log.Printf("SOCKS5 proxy %s: %v", name, err)
+		return
+	}
+
+	req, rep, err := readSOCKS5Request(conn)
+	if err != nil {
+		log.Printf("SOCKS5 proxy %s: %v", name, err)
+		if rep != socks5RepSucceeded {
+			writeSOCKS5Reply(conn, rep, nil)
+		}
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	switch req.cmd {
+	case socks5CmdConnect:
+		h.socks5Connect(conn, name, cfg, req)
+	case socks5CmdUDPAssociate:
+		h.socks5UDPAssociate(conn, name, cfg, peer)
+	default:
+		log.Printf("SOCKS5 proxy %s: unsupported command %d", name, req.cmd)
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+	}
+}
+
+// socks5Authenticate negotiates the auth method and checks username and password if required
+func socks5Authenticate(conn net.Conn, cfg *SOCKS5Config) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("failed to read auth methods: %w", err)
+	}
+
+	method := byte(socks5MethodNone)
+	if cfg.Username != "" {
+		method = socks5MethodPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return fmt.Errorf("no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+
+	if method == socks5MethodNone {
+		return nil
+	}
+
+	// RFC 1929: ver | ulen | uname | plen | passwd
+	fields := make([]string, 2)
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if lenBuf[0] != socks5AuthVersion {
+		return fmt.Errorf("unsupported auth version %d", lenBuf[0])
+	}
+	for i := range fields {
+		field := make([]byte, lenBuf[1])
+		if _, err := io.ReadFull(conn, field); err != nil {
+			return fmt.Errorf("failed to read credentials: %w", err)
+		}
+		fields[i] = string(field)
+
+		if i == 0 {
+			if _, err := io.ReadFull(conn, lenBuf[1:]); err != nil {
+				return fmt.Errorf("failed to read credentials: %w", err)
+			}
+		}
+	}
+
+	userOK := subtle.ConstantTimeCompare([]byte(fields[0]), []byte(cfg.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(fields[1]), []byte(cfg.Password))
+	if userOK&passOK != 1 {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return fmt.Errorf("invalid credentials for user %q", fields[0])
+	}
+
+	_, err := conn.Write([]byte{socks5AuthVersion, 0x00})
+	return err
+}
+
+// readSOCKS5Request reads a request; on error rep is the reply code to send, if any
+func readSOCKS5Request(r io.Reader) (*socks5Request, byte, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, socks5RepSucceeded, fmt.Errorf("failed to read request: %w", err)
+	}
+	if header[0] != socks5Version {
+		return nil, socks5RepGeneralFailure, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return nil, socks5RepAtypNotSupported, err
+	}
+
+	return &socks5Request{cmd: header[1], host: host, port: port}, socks5RepSucceeded, nil
+}
+
+// readSOCKS5Addr reads atyp | addr | port
+func readSOCKS5Addr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, fmt.Errorf("failed to read address: %w", err)
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		nameLen := make([]byte, 1)
+		if _, err := io.ReadFull(r, nameLen); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		name := make([]byte, nameLen[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, fmt.Errorf("failed to read address: %w", err)
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("unsupported address type %d", atyp[0])
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", 0, fmt.Errorf("failed to read port: %w", err)
+	}
+	return host, int(binary.BigEndian.Uint16(portBuf)), nil
+}
+
+// appendSOCKS5Host appends atyp | addr | port for an IP address or a domain name
+func appendSOCKS5Host(buf []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSOCKS5Addr(buf, ip, port)
+	}
+	buf = append(buf, socks5AtypDomain, byte(len(host)))
+	buf = append(buf, host...)
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// appendSOCKS5Addr appends atyp | addr | port
+func appendSOCKS5Addr(buf []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socks5AtypIPv4)
+		buf = append(buf, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		buf = append(buf, socks5AtypIPv6)
+		buf = append(buf, ip16...)
+	} else {
+		buf = append(buf, socks5AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// writeSOCKS5Reply writes ver | rep | rsv | bound address; addr may be nil
+func writeSOCKS5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	_, err := w.Write(appendSOCKS5Addr([]byte{socks5Version, rep, 0x00}, ip, port))
+	return err
+}
+
+// socks5Destination checks a destination against allowed_targets and the proxy's
+// allowed_destinations and returns the address to dial. Hostnames that are not
+// listed by name are resolved so DNS cannot point outside the lists.
+func (h *Handler) socks5Destination(cfg *SOCKS5Config, host string, port int) (string, error) {
+	ipAllowed := func(ip net.IP) bool {
+		return h.config.IPAllowed(ip) && (cfg.allowed.empty() || cfg.allowed.ipListed(ip))
+	}
+	portStr := strconv.Itoa(port)
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !ipAllowed(ip) {
+			return "", fmt.Errorf("%s is not an allowed destination", host)
+		}
+		return net.JoinHostPort(host, portStr), nil
+	}
+
+	globalByName := len(h.config.AllowedTargets) == 0 || strings.EqualFold(host, "localhost") || h.config.allowed.hostListed(host)
+	if globalByName && (cfg.allowed.empty() || cfg.allowed.hostListed(host)) {
+		return net.JoinHostPort(host, portStr), nil
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ipAllowed(ip) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not an allowed destination", host)
+}
+
+// socks5Connect handles CONNECT: dial the destination and pipe the stream to it
+func (h *Handler) socks5Connect(conn net.Conn, name string, cfg *SOCKS5Config, req *socks5Request) {
+	target, err := h.socks5Destination(cfg, req.host, req.port)
+	if err != nil {
+		log.Printf("SOCKS5 proxy %s refused CONNECT to %s:%d: %v", name, req.host, req.port, err)
+		writeSOCKS5Reply(conn, socks5RepNotAllowed, nil)
+		return
+	}
+
+	out, err := net.DialTimeout("tcp", target, socks5DialTimeout)
+	if err != nil {
+		log.Printf("SOCKS5 proxy %s failed to connect to %s: %v", name, target, err)
+		writeSOCKS5Reply(conn, socks5DialReply(err), nil)
+		return
+	}
+	defer out.Close()
+
+	if err := writeSOCKS5Reply(conn, socks5RepSucceeded, out.LocalAddr()); err != nil {
+		return
+	}
+	log.Printf("SOCKS5 proxy %s connected to %s", name, target)
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(out, conn)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, out)
+		errCh <- err
+	}()
+
+	if err := <-errCh; err != nil && err != io.EOF {
+		log.Printf("Error in SOCKS5 proxy %s forwarding: %v", name, err)
+	}
+}
+
+// socks5DialReply maps a dial error to a SOCKS5 reply code
+func socks5DialReply(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &netErr) && netErr.Timeout():
+		return socks5RepHostUnreachable
+	}
+	return socks5RepGeneralFailure
+}
+
+// socks5UDPName is the name the UDP side of a socks5 proxy is registered under
+func socks5UDPName(name string) string {
+	return name + "/udp"
+}
+
+// socks5UDPAssociate handles UDP ASSOCIATE. Datagrams go to the server on the
+// proxy's remote port over UDP and reach the client through the tunnel; only
+// the SOCKS client's IP may use them, and only until this stream closes.
+func (h *Handler) socks5UDPAssociate(conn net.Conn, name string, cfg *SOCKS5Config, peer string) {
+	ip, _, err := net.SplitHostPort(peer)
+	if !cfg.UDP || err != nil {
+		log.Printf("SOCKS5 proxy %s refused UDP ASSOCIATE: udp is not enabled", name)
+		writeSOCKS5Reply(conn, socks5RepCmdNotSupported, nil)
+		return
+	}
+
+	release := h.socks5Assocs.add(name, ip)
+	defer release()
+
+	host := cfg.UDPHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(h.config.Server)
+	}
+	reply := appendSOCKS5Host([]byte{socks5Version, socks5RepSucceeded, 0x00}, host, cfg.udpPort)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	log.Printf("SOCKS5 proxy %s relaying UDP for %s", name, ip)
+
+	// The association lasts as long as the stream
+	io.Copy(io.Discard, conn)
+	log.Printf("SOCKS5 proxy %s UDP association for %s closed", name, ip)
+}
+
+// serveSOCKS5UDP relays the SOCKS5 UDP requests of one public peer, carried as
+// length-prefixed datagrams on stream, until the peer's association closes
+func (h *Handler) serveSOCKS5UDP(stream *smux.Stream, name string, cfg *SOCKS5Config, peer string) {
+	ip, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		log.Printf("SOCKS5 proxy %s: no peer address on UDP stream %d", name, stream.ID())
+		return
+	}
+	closed := h.socks5Assocs.lookup(name, ip)
+	if closed == nil {
+		log.Printf("SOCKS5 proxy %s dropped UDP from %s: no UDP ASSOCIATE", name, peer)
+		return
+	}
+
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("SOCKS5 proxy %s failed to open UDP socket: %v", name, err)
+		return
+	}
+	defer outbound.Close()
+
+	sess := &udpSession{stream: stream, conn: outbound}
+	sess.touch()
+	if !h.udpSessions.add(sess) {
+		log.Printf("Too many UDP sessions, rejecting stream %d", stream.ID())
+		return
+	}
+	defer h.udpSessions.remove(sess)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-closed:
+			stream.Close()
+			outbound.Close()
+		case <-done:
+		}
+	}()
+
+	assoc := &socks5UDPRelay{
+		resolved:  make(map[string]*net.UDPAddr),
+		contacted: make(map[string]bool),
+	}
+	go assoc.replies(outbound, stream, sess)
+
+	lenBuf := make([]byte, 2)
+	buf := make([]byte, 65535)
+	for {
+		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(stream, buf[:n]); err != nil {
+			return
+		}
+		sess.touch()
+
+		// rsv(2) | frag | atyp | addr | port | data; fragments are not supported
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+
+		dest, err := h.socks5UDPDestination(cfg, assoc, host, port)
+		if err != nil {
+			log.Printf("SOCKS5 proxy %s dropped datagram for %s:%d: %v", name, host, port, err)
+			continue
+		}
+
+		assoc.contact(dest)
+		outbound.WriteToUDP(payload, dest)
+	}
+}
+
+// socks5UDPDestination checks and resolves a datagram destination, caching the result
+func (h *Handler) socks5UDPDestination(cfg *SOCKS5Config, assoc *socks5UDPRelay, host string, port int) (*net.UDPAddr, error) {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+
+	assoc.mu.Lock()
+	dest, cached := assoc.resolved[key]
+	assoc.mu.Unlock()
+	if cached {
+		return dest, nil
+	}
+
+	target, err := h.socks5Destination(cfg, host, port)
+	if err != nil {
+		return nil, err
+	}
+	dest, err = net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	assoc.mu.Lock()
+	if len(assoc.resolved) >= socks5MaxResolved {
+		assoc.resolved = make(map[string]*net.UDPAddr)
+	}
+	assoc.resolved[key] = dest
+	assoc.mu.Unlock()
+	return dest, nil
+}
+
+// socks5MaxResolved bounds the destinations cached per UDP relay
+const socks5MaxResolved = 256
+
+// socks5UDPRelay tracks the destinations one peer's datagrams were sent to
+type socks5UDPRelay struct {
+	resolved  map[string]*net.UDPAddr
+	contacted map[string]bool // Only these destinations may send replies
+	mu        sync.Mutex
+}
+
+func (a *socks5UDPRelay) contact(dest *net.UDPAddr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.contacted) >= socks5MaxResolved && !a.contacted[dest.String()] {
+		a.contacted = make(map[string]bool)
+	}
+	a.contacted[dest.String()] = true
+}
+
+// replies wraps datagrams from contacted destinations and sends them back over the stream
+func (a *socks5UDPRelay) replies(outbound *net.UDPConn, stream *smux.Stream, sess *udpSession) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := outbound.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		known := a.contacted[from.String()]
+		a.mu.Unlock()
+		if !known {
+			continue
+		}
+
+		packet := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, from.IP, from.Port)
+		packet = append(packet, buf[:n]...)
+		if len(packet) > 65535 {
+			continue
+		}
+		sess.touch()
+
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+		if _, err := stream.Write(append(frame, packet...)); err != nil {
+			return
+		}
+	}
+}
+
+// socks5Associations tracks the open UDP ASSOCIATE requests by proxy and SOCKS client IP
+type socks5Associations struct {
+	open map[socks5AssocKey]*socks5Association
+	mu   sync.Mutex
+}
+
+type socks5AssocKey struct {
+	proxy string
+	ip    string
+}
+
+// socks5Association counts the UDP ASSOCIATE streams of one IP; closed is
+// closed once the last of them ends
+type socks5Association struct {
+	count  int
+	closed chan struct{}
+}
+
+func newSOCKS5Associations() *socks5Associations {
+	return &socks5Associations{open: make(map[socks5AssocKey]*socks5Association)}
+}
+
+// add opens an association for ip; the returned func ends it
+func (a *socks5Associations) add(proxy, ip string) func() {
+	key := socks5AssocKey{proxy: proxy, ip: ip}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	assoc := a.open[key]
+	if assoc == nil {
+		assoc = &socks5Association{closed: make(chan struct{})}
+		a.open[key] = assoc
+	}
+	assoc.count++
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		assoc.count--
+		if assoc.count == 0 {
+			close(assoc.closed)
+			delete(a.open, key)
+		}
+	}
+}
+
+// lookup returns a channel closed when ip's associations end, or nil if it has none
+func (a *socks5Associations) lookup(proxy, ip string) <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if assoc := a.open[socks5AssocKey{proxy: proxy, ip: ip}]; assoc != nil {
+		return assoc.closed
+	}
+	return nil
+}
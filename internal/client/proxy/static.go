@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// staticReadHeaderTimeout bounds how long a tunneled HTTP client may take to send request headers
+	staticReadHeaderTimeout = 30 * time.Second
+	// staticIdleTimeout closes kept-alive streams that send no new request
+	staticIdleTimeout = 2 * time.Minute
+)
+
+// StaticConfig configures the file server the client runs for a static proxy
+type StaticConfig struct {
+	Root         string `yaml:"root"`          // Directory to serve; dotfiles and symlinks leading outside it are hidden
+	HideListings bool   `yaml:"hide_listings"` // Return 404 for directories without an index.html
+	Username     string `yaml:"username"`      // Require HTTP basic auth when set
+	Password     string `yaml:"password"`
+
+	handler http.Handler
+}
+
+func (c *StaticConfig) validate() error {
+	if c.Root == "" {
+		return fmt.Errorf("static proxies need a root directory")
+	}
+	info, err := os.Stat(c.Root)
+	if err != nil {
+		return fmt.Errorf("cannot access static root: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("static root %s is not a directory", c.Root)
+	}
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("static password needs a username")
+	}
+
+	root, err := filepath.Abs(c.Root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot resolve static root: %w", err)
+	}
+
+	var fsys http.FileSystem = rootedFS{root: root, fs: http.Dir(root)}
+	if c.HideListings {
+		fsys = noListingFS{fsys}
+	}
+	c.handler = http.FileServer(fsys)
+	if c.Username != "" {
+		c.handler = c.basicAuth(c.handler)
+	}
+	return nil
+}
+
+// basicAuth rejects requests without the configured username and password
+func (c *StaticConfig) basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.Username))
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(c.Password))
+		if userOK&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mgrok", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rootedFS hides dotfiles such as .git and .env, and files that symlinks
+// resolve to outside the root
+type rootedFS struct {
+	root string // Absolute, with symlinks resolved
+	fs   http.FileSystem
+}
+
+func (r rootedFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	real, err := filepath.EvalSymlinks(filepath.Join(r.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	if real != r.root && !strings.HasPrefix(real, r.root+string(filepath.Separator)) {
+		return nil, fs.ErrNotExist
+	}
+
+	f, err := r.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return noDotfilesFile{f}, nil
+}
+
+// noDotfilesFile leaves dotfiles out of directory listings
+type noDotfilesFile struct {
+	http.File
+}
+
+func (f noDotfilesFile) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// noListingFS hides directories that have no index.html
+type noListingFS struct {
+	fs http.FileSystem
+}
+
+func (n noListingFS) Open(name string) (http.File, error) {
+	f, err := n.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		index, err := n.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// serveStatic serves HTTP for the file server on a single stream from the server
+func serveStatic(conn net.Conn, name string, cfg *StaticConfig) {
+	server := &http.Server{
+		Handler:           cfg.handler,
+		ReadHeaderTimeout: staticReadHeaderTimeout,
+		IdleTimeout:       staticIdleTimeout,
+		ErrorLog:          log.New(log.Writer(), fmt.Sprintf("Static proxy %s: ", name), log.LstdFlags),
+	}
+
+	// Serve returns once the connection is closed
+	server.Serve(newSingleConnListener(conn))
+}
+
+// singleConnListener hands out one connection and then blocks until it is closed
+type singleConnListener struct {
+	conn   net.Conn
+	done   chan struct{}
+	once   sync.Once
+	served bool
+	mu     sync.Mutex
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{done: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: conn, onClose: func() { l.once.Do(func() { close(l.done) }) }}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	served := l.served
+	l.served = true
+	l.mu.Unlock()
+
+	if !served {
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// notifyCloseConn calls onClose when the connection is closed
+type notifyCloseConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	defaultUDPSessionTimeout = 60 * time.Second
+	defaultMaxUDPSessions    = 1024
+)
+
+// udpSession pairs the stream for one remote peer with its local UDP socket
+type udpSession struct {
+	stream     *smux.Stream
+	conn       *net.UDPConn
+	lastActive atomic.Int64 // unix nanoseconds
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// udpSessionCache tracks the local sockets of all UDP peers so that idle ones
+// are closed and the number of open sockets stays bounded. Sessions are keyed
+// by their stream, since stream IDs repeat across the client's smux sessions.
+type udpSessionCache struct {
+	timeout     time.Duration
+	maxSessions int
+	sessions    map[*smux.Stream]*udpSession
+	reaping     bool
+	mu          sync.Mutex
+}
+
+func newUDPSessionCache(timeout time.Duration, maxSessions int) *udpSessionCache {
+	if timeout <= 0 {
+		timeout = defaultUDPSessionTimeout
+	}
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxUDPSessions
+	}
+
+	return &udpSessionCache{
+		timeout:     timeout,
+		maxSessions: maxSessions,
+		sessions:    make(map[*smux.Stream]*udpSession),
+	}
+}
+
+// add stores a session; returns false if the cache is full
+func (c *udpSessionCache) add(sess *udpSession) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.sessions) >= c.maxSessions {
+		return false
+	}
+	c.sessions[sess.stream] = sess
+
+	if !c.reaping {
+		c.reaping = true
+		go c.reap()
+	}
+	return true
+}
+
+func (c *udpSessionCache) remove(sess *udpSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sessions, sess.stream)
+}
+
+// reap closes sessions that have been idle longer than the timeout; it stops once the cache is empty
+func (c *udpSessionCache) reap() {
+	ticker := time.NewTicker(c.timeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := time.Now().Add(-c.timeout).UnixNano()
+
+		c.mu.Lock()
+		for stream, sess := range c.sessions {
+			if sess.lastActive.Load() < deadline {
+				log.Printf("Closing idle UDP session for stream %d", stream.ID())
+				// closing both ends unblocks the forwarding goroutines, which then remove the session
+				sess.conn.Close()
+				sess.stream.Close()
+			}
+		}
+		if len(c.sessions) == 0 {
+			c.reaping = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// forwardUDP relays length-prefixed datagrams between the stream and a local UDP service
+func (h *Handler) forwardUDP(stream *smux.Stream, streamID uint32, localAddr string) {
+	udpAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		log.Printf("Failed to resolve UDP address %s: %v", localAddr, err)
+		return
+	}
+	udpConn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		log.Printf("Failed to dial UDP %s: %v", localAddr, err)
+		return
+	}
+	defer udpConn.Close()
+
+	sess := &udpSession{stream: stream, conn: udpConn}
+	sess.touch()
+	if !h.udpSessions.add(sess) {
+		log.Printf("Too many UDP sessions, rejecting stream %d", streamID)
+		return
+	}
+	defer h.udpSessions.remove(sess)
+
+	errCh := make(chan error, 2)
+
+	// bidirectional UDP forwarding
+	// to local udp service
+	go func() {
+		// responses are read after a 2 byte length prefix so each one goes out in a single write
+		frame := make([]byte, 2+65535)
+		for {
+			n, err := udpConn.Read(frame[2:])
+			if err != nil {
+				errCh <- err
+				return
+			}
+			sess.touch()
+			binary.BigEndian.PutUint16(frame[:2], uint16(n))
+			if _, err := stream.Write(frame[:2+n]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	// to server on udp port
+	go func() {
+		lenBuf := make([]byte, 2)
+		data := make([]byte, 65535)
+		for {
+			if _, err := io.ReadFull(stream, lenBuf); err != nil {
+				errCh <- err
+				return
+			}
+			l := binary.BigEndian.Uint16(lenBuf)
+			if _, err := io.ReadFull(stream, data[:l]); err != nil {
+				errCh <- err
+				return
+			}
+			sess.touch()
+			if _, err := udpConn.Write(data[:l]); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	err = <-errCh
+	if err != nil && err != io.EOF {
+		log.Printf("UDP forwarding error: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// smuxPair returns the client and server ends of an in-memory smux session
+func smuxPair(t *testing.T) (client, server *smux.Session) {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	client, err := smux.Client(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = smux.Server(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// udpEcho starts a local UDP service that sends every datagram back
+func udpEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// udpRoundTrip sends one datagram over a server stream and reads the echo
+func udpRoundTrip(t *testing.T, stream *smux.Stream, payload string) {
+	t.Helper()
+
+	frame := make([]byte, 2, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	if _, err := stream.Write(append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, frame[:2]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, binary.BigEndian.Uint16(frame[:2]))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != payload {
+		t.Fatalf("got %q, want %q", got, payload)
+	}
+}
+
+func (c *udpSessionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.sessions)
+}
+
+func TestUDPSessionsWithSameStreamID(t *testing.T) {
+	h := &Handler{udpSessions: newUDPSessionCache(time.Minute, 10)}
+	echo := udpEcho(t)
+
+	// Each smux session numbers the streams the server opens the same way
+	var serverStreams, clientStreams []*smux.Stream
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		client, server := smuxPair(t)
+		serverStream, err := server.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientStream, err := client.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverStreams = append(serverStreams, serverStream)
+		clientStreams = append(clientStreams, clientStream)
+
+		go func() {
+			h.forwardUDP(clientStream, clientStream.ID(), echo)
+			done <- struct{}{}
+		}()
+	}
+	if clientStreams[0].ID() != clientStreams[1].ID() {
+		t.Fatalf("expected equal stream IDs, got %d and %d", clientStreams[0].ID(), clientStreams[1].ID())
+	}
+
+	udpRoundTrip(t, serverStreams[0], "first")
+	udpRoundTrip(t, serverStreams[1], "second")
+	if n := h.udpSessions.len(); n != 2 {
+		t.Fatalf("got %d cached UDP sessions, want 2", n)
+	}
+
+	// Ending one peer must leave the other one's session alone
+	clientStreams[0].Close()
+	<-done
+	if n := h.udpSessions.len(); n != 1 {
+		t.Fatalf("got %d cached UDP sessions after closing one, want 1", n)
+	}
+	udpRoundTrip(t, serverStreams[1], "still there")
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+// StartVisitors opens the local listener of every visitor. Must be called after
+// RegisterProxies so the server has authenticated the session.
+func (h *Handler) StartVisitors() error {
+	for name, visitor := range h.config.Visitors {
+		label := fmt.Sprintf("Visitor %s for secret proxy %s", name, visitor.ServerName)
+
+		addr, err := h.listenLocal(label, localBindAddress(visitor.BindAddr, visitor.BindPort), func(conn net.Conn) {
+			h.relay(label, conn, func(w io.Writer) error {
+				return tunnel.WriteVisit(w, visitor.ServerName, visitor.Secret)
+			}, visitor.e2e)
+		})
+		if err != nil {
+			return fmt.Errorf("visitor %s: %w", name, err)
+		}
+		log.Printf("%s listening on %s", label, addr)
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/markCwatson/mgrok/internal/transport"
+	"github.com/markCwatson/mgrok/internal/tunnel"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,17 +21,92 @@ type ServerConfig struct {
 	AuthToken      string `yaml:"auth_token"`
 	PortRangeStart int    `yaml:"port_range_start"`
 	PortRangeEnd   int    `yaml:"port_range_end"`
+
+	// Extra tunnel listeners, each using a registered transport. The main port
+	// always accepts tcp; these run alongside it.
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// Also accept tunnels as WebSocket upgrades (wss:// when enable_tls is set)
+	// on this port and path, for clients that can only get out over HTTP(S)
+	WebSocketPort int    `yaml:"websocket_port"`
+	WebSocketPath string `yaml:"websocket_path"` // default "/mgrok"
+
+	// Also accept tunnels over KCP (reliable UDP) on this UDP port
+	KCPPort int                 `yaml:"kcp_port"`
+	KCP     transport.KCPConfig `yaml:"kcp"`
+
+	// Also accept tunnels encrypted with a Noise handshake on this TCP port.
+	// Clients pin the server's public key instead of trusting a certificate.
+	NoisePort int                   `yaml:"noise_port"`
+	Noise     transport.NoiseConfig `yaml:"noise"`
+
+	// smux session and TCP socket tuning for client connections
+	Mux tunnel.MuxConfig `yaml:"mux"`
+
+	// Named certificates for proxies that terminate TLS on the server.
+	// Proxies that don't name one use TLSCertFile/TLSKeyFile.
+	Certificates map[string]CertConfig `yaml:"certificates"`
+
+	// Default access lists for proxies that do not send their own.
+	// A proxy's allow list replaces AllowCIDRs; DenyCIDRs always apply.
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	DenyCIDRs  []string `yaml:"deny_cidrs"`
+
+	// Bandwidth caps in bytes per second (0 means unlimited). A proxy's own
+	// limit is lowered to MaxProxyBandwidth; the client and token caps are
+	// shared by all proxies of a client and all clients using a token.
+	MaxProxyBandwidth  int `yaml:"max_proxy_bandwidth"`
+	MaxClientBandwidth int `yaml:"max_client_bandwidth"`
+	MaxTokenBandwidth  int `yaml:"max_token_bandwidth"`
+	BandwidthBurst     int `yaml:"bandwidth_burst"`
+
+	// Seconds between proxy stats log lines (0 disables them)
+	StatsInterval int `yaml:"stats_interval"`
+
+	// Admission control for public listeners. When a limit is reached a new
+	// connection is either rejected or queued for up to QueueTimeout seconds,
+	// with at most MaxQueue connections waiting (default 256).
+	MaxStreamsPerSession int     `yaml:"max_streams_per_session"`
+	AcceptRatePerIP      float64 `yaml:"accept_rate_per_ip"` // new connections per second
+	AcceptBurstPerIP     int     `yaml:"accept_burst_per_ip"`
+	LimitPolicy          string  `yaml:"limit_policy"` // "reject" (default) or "queue"
+	QueueTimeout         int     `yaml:"queue_timeout"`
+	MaxQueue             int     `yaml:"max_queue"`
+
+	// UDP proxies reuse one stream per remote peer; idle peers are dropped
+	// after UDPSessionTimeout seconds (default 60, max 1024 peers per proxy)
+	UDPSessionTimeout int `yaml:"udp_session_timeout"`
+	MaxUDPSessions    int `yaml:"max_udp_sessions"`
+
+	// Streams a client may open in advance per proxy with pool_count
+	// (default 10); larger requests are capped
+	MaxPoolCount int `yaml:"max_pool_count"`
+
+	// Destinations clients may reach with local port forwarding, as host,
+	// host:port, CIDR or [CIDR]:port entries. Empty disables forwarding.
+	ForwardTargets []string `yaml:"forward_targets"`
+}
+
+// ListenerConfig is one tunnel listener
+type ListenerConfig struct {
+	Transport string `yaml:"transport"` // "tcp", "websocket", "kcp", …
+	BindAddr  string `yaml:"bind_addr"` // default all interfaces
+	Port      int    `yaml:"port"`
+	Path      string `yaml:"path"` // websocket only, default websocket_path
+}
+
+// CertConfig is a certificate and key pair on disk
+type CertConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 // LoadServerConfig loads the server configuration from a YAML file
 func LoadServerConfig(configPath string) (*ServerConfig, error) {
 	// Expand home directory if needed
-	if configPath[:2] == "~/" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return nil, err
-		}
-		configPath = filepath.Join(home, configPath[2:])
+	configPath, err := expandHome(configPath)
+	if err != nil {
+		return nil, err
 	}
 
 	data, err := os.ReadFile(configPath)
@@ -41,21 +120,85 @@ func LoadServerConfig(configPath string) (*ServerConfig, error) {
 	}
 
 	// Expand home directory in file paths if needed
-	if config.TLSCertFile[:2] == "~/" {
-		home, err := os.UserHomeDir()
-		if err != nil {
+	if config.TLSCertFile, err = expandHome(config.TLSCertFile); err != nil {
+		return nil, err
+	}
+	if config.TLSKeyFile, err = expandHome(config.TLSKeyFile); err != nil {
+		return nil, err
+	}
+	for name, cert := range config.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return nil, fmt.Errorf("certificate %q needs both cert_file and key_file", name)
+		}
+		if cert.CertFile, err = expandHome(cert.CertFile); err != nil {
 			return nil, err
 		}
-		config.TLSCertFile = filepath.Join(home, config.TLSCertFile[2:])
+		if cert.KeyFile, err = expandHome(cert.KeyFile); err != nil {
+			return nil, err
+		}
+		config.Certificates[name] = cert
 	}
 
-	if config.TLSKeyFile[:2] == "~/" {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return nil, err
+	if config.WebSocketPath != "" && !strings.HasPrefix(config.WebSocketPath, "/") {
+		return nil, fmt.Errorf("invalid websocket_path %q: must start with /", config.WebSocketPath)
+	}
+
+	if err := config.KCP.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Noise.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Mux.SmuxConfig(); err != nil {
+		return nil, err
+	}
+
+	// The websocket_port, kcp_port and noise_port settings are shorthand for listeners
+	if config.WebSocketPort > 0 {
+		config.Listeners = append(config.Listeners, ListenerConfig{Transport: "websocket", Port: config.WebSocketPort})
+	}
+	if config.KCPPort > 0 {
+		config.Listeners = append(config.Listeners, ListenerConfig{Transport: "kcp", Port: config.KCPPort})
+	}
+	if config.NoisePort > 0 {
+		config.Listeners = append(config.Listeners, ListenerConfig{Transport: "noise", Port: config.NoisePort})
+	}
+	for i, l := range config.Listeners {
+		if !transport.Registered(l.Transport) {
+			return nil, fmt.Errorf("listener %d: unknown transport %q (available: %v)", i, l.Transport, transport.Names())
+		}
+		if l.Port <= 0 || l.Port > 65535 {
+			return nil, fmt.Errorf("listener %d: invalid port %d", i, l.Port)
+		}
+		if l.Path != "" && !strings.HasPrefix(l.Path, "/") {
+			return nil, fmt.Errorf("listener %d: invalid path %q: must start with /", i, l.Path)
+		}
+		if l.Transport == "noise" && config.Noise.PrivateKey == "" {
+			return nil, fmt.Errorf("listener %d: the noise transport needs noise.private_key (generate one with -gen-noise-key)", i)
 		}
-		config.TLSKeyFile = filepath.Join(home, config.TLSKeyFile[2:])
+		if l.Path == "" {
+			config.Listeners[i].Path = config.WebSocketPath
+		}
+	}
+
+	switch config.LimitPolicy {
+	case "", "reject", "queue":
+	default:
+		return nil, fmt.Errorf("invalid limit_policy %q: must be \"reject\" or \"queue\"", config.LimitPolicy)
 	}
 
 	return &config, nil
 }
+
+// expandHome replaces a leading "~/" with the user's home directory
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[2:]), nil
+}
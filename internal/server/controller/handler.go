@@ -2,26 +2,39 @@ package controller
 
 import (
 	"bytes"
-	"encoding/binary"
+	cryptotls "crypto/tls"
+	"fmt"
+	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/markCwatson/mgrok/internal/config"
 	"github.com/markCwatson/mgrok/internal/server/proxy"
+	"github.com/markCwatson/mgrok/internal/server/tls"
 	"github.com/markCwatson/mgrok/internal/tunnel"
 	"github.com/xtaci/smux"
+	"golang.org/x/time/rate"
 )
 
 // Handler handles control connections
 type Handler struct {
 	proxyManager *proxy.Manager
+	tlsManager   *tls.Manager
 	serverConfig *config.ServerConfig
+
+	// bandwidth limiters shared by every client authenticated with the same token
+	tokenLimiters map[string]*rate.Limiter
+	mu            sync.Mutex
 }
 
 // NewHandler creates a new control handler
-func NewHandler(proxyManager *proxy.Manager, serverConfig *config.ServerConfig) *Handler {
+func NewHandler(proxyManager *proxy.Manager, tlsManager *tls.Manager, serverConfig *config.ServerConfig) *Handler {
 	return &Handler{
-		proxyManager: proxyManager,
-		serverConfig: serverConfig,
+		proxyManager:  proxyManager,
+		tlsManager:    tlsManager,
+		serverConfig:  serverConfig,
+		tokenLimiters: make(map[string]*rate.Limiter),
 	}
 }
 
@@ -36,14 +49,17 @@ func (h *Handler) HandleConnection(ctrlStream *smux.Stream, session *smux.Sessio
 	}
 
 	client.CtrlStream = ctrlStream
-	buffer := make([]byte, 1024)
+
+	// Closing the stream tells a client waiting for a reply that it was refused
+	defer ctrlStream.Close()
 
 	// Read and validate handshake
-	n, err := ctrlStream.Read(buffer)
+	buffer, err := tunnel.ReadControl(ctrlStream)
 	if err != nil {
 		log.Printf("Error reading handshake: %v", err)
 		return
 	}
+	n := len(buffer)
 
 	if n > 5 {
 		log.Printf("Handshake received (%d bytes): [% x] + auth payload (%d bytes)", 5, buffer[:5], n-5)
@@ -80,6 +96,10 @@ func (h *Handler) HandleConnection(ctrlStream *smux.Stream, session *smux.Sessio
 		}
 
 		log.Printf("Authentication successful")
+
+		client.Limiter = proxy.NewBandwidthLimiter(h.serverConfig.MaxClientBandwidth, h.serverConfig.BandwidthBurst)
+		client.TokenLimiter = h.tokenLimiter(clientAuthToken)
+		client.SetAuthenticated()
 	} else {
 		log.Printf("Unsupported auth method: %d", authMethod)
 		return
@@ -87,74 +107,369 @@ func (h *Handler) HandleConnection(ctrlStream *smux.Stream, session *smux.Sessio
 
 	// Process control messages
 	for {
-		n, err := ctrlStream.Read(buffer)
+		msg, err := tunnel.ReadControl(ctrlStream)
 		if err != nil {
 			log.Printf("Control connection closed: %v", err)
 			break
 		}
 
-		if n < 1 {
-			log.Printf("Received empty message, skipping")
-			continue
-		}
+		msgType := msg[0]
 
-		// Dump raw message for debugging
-		log.Printf("Received message (%d bytes): [% x]", n, buffer[:n])
+		// Dump raw message for debugging; register messages may carry secrets so they are not dumped
+		if msgType != tunnel.MsgTypeRegister {
+			log.Printf("Received message (%d bytes): [% x]", len(msg), msg)
+		}
 
-		msgType := buffer[0]
 		log.Printf("Message type: 0x%02x", msgType)
 
+		// A joined session only carries data streams; its proxies would outlive it
+		if client.Joined() && msgType != tunnel.MsgTypeHeartbeat {
+			log.Printf("Ignoring message 0x%02x from joined session %s", msgType, clientID)
+			continue
+		}
+
 		switch msgType {
 		case tunnel.MsgTypeRegister:
-			h.handleRegisterMsg(client, buffer[1:n])
+			h.handleRegisterMsg(client, ctrlStream, msg[1:])
+		case tunnel.MsgTypeStatus:
+			h.handleStatusMsg(client, msg[1:])
+		case tunnel.MsgTypeJoin:
+			h.handleJoinMsg(client, ctrlStream, msg[1:])
 		case tunnel.MsgTypeHeartbeat:
 			log.Printf("Received heartbeat")
 			// Echo back heartbeat
-			_, _ = ctrlStream.Write([]byte{tunnel.MsgTypeHeartbeat})
+			_ = tunnel.WriteHeartbeat(ctrlStream)
 		default:
 			log.Printf("Unknown message type: 0x%02x", msgType)
 		}
 	}
 }
 
-// handleRegisterMsg handles a register message
-func (h *Handler) handleRegisterMsg(client *proxy.ClientInfo, data []byte) {
-	log.Printf("Register message received (%d bytes): [% x]", len(data), data)
+// handleRegisterMsg handles a register message and answers it with a register reply
+func (h *Handler) handleRegisterMsg(client *proxy.ClientInfo, ctrlStream *smux.Stream, data []byte) {
+	log.Printf("Register message received (%d bytes)", len(data))
 
-	if len(data) < 5 { // proxyType(1) + remotePort(2) + localPort(2) + at least 1 byte name
-		log.Printf("Register message too short: expected at least 5 bytes, got %d", len(data))
+	msg, err := tunnel.ParseRegister(data)
+	if err != nil {
+		log.Printf("Invalid register message: %v", err)
+		// Still answer, so the client's replies stay in step with its requests
+		_ = tunnel.WriteRegisterReply(ctrlStream, &tunnel.RegisterReplyMsg{Reply: tunnel.ReplyDenied, Error: err.Error()})
 		return
 	}
 
-	proxyType := data[0]
-	remotePort := binary.BigEndian.Uint16(data[1:3])
-	localPort := binary.BigEndian.Uint16(data[3:5])
-	name := string(data[5:])
-
 	log.Printf("Parsed registration request: %s, type=%d, remote_port=%d, local_port=%d",
-		name, proxyType, remotePort, localPort)
+		msg.Name, msg.ProxyType, msg.RemotePort, msg.LocalPort)
+
+	reply := &tunnel.RegisterReplyMsg{Reply: tunnel.ReplyOK, Name: msg.Name, Compression: msg.Compression}
+	if err := h.registerProxy(client, msg); err != nil {
+		log.Printf("Failed to register proxy %s: %v", msg.Name, err)
+		reply = &tunnel.RegisterReplyMsg{Reply: tunnel.ReplyDenied, Name: msg.Name, Error: err.Error()}
+	}
+
+	if err := tunnel.WriteRegisterReply(ctrlStream, reply); err != nil {
+		log.Printf("Failed to answer registration of proxy %s: %v", msg.Name, err)
+	}
+}
 
-	newProxy, err := h.proxyManager.RegisterProxy(client, name, proxyType, remotePort, localPort)
+// registerProxy checks a register message and registers the proxy, starting its public listener
+func (h *Handler) registerProxy(client *proxy.ClientInfo, msg *tunnel.RegisterMsg) error {
+	acl, err := h.accessList(msg)
 	if err != nil {
-		log.Printf("Failed to register proxy: %v", err)
-		// TODO: Send back error response
-		return
+		return err
+	}
+
+	if msg.ProxyType == tunnel.ProxyTypeSTCP && msg.Secret == "" {
+		return fmt.Errorf("secret proxies need a secret")
+	}
+
+	// Without a key anyone who knows the group name could take a share of its traffic
+	if msg.Group != "" && msg.GroupKey == "" {
+		return fmt.Errorf("group %s needs a group key", msg.Group)
+	}
+
+	if !tunnel.ValidCompression(msg.Compression) {
+		return fmt.Errorf("unsupported compression %q", msg.Compression)
+	}
+	if msg.Compression != "" && msg.ProxyType == tunnel.ProxyTypeUDP {
+		return fmt.Errorf("compression is not supported for UDP proxies")
+	}
+
+	var tlsConfig *cryptotls.Config
+	if msg.TLSTermination {
+		if msg.ProxyType != tunnel.ProxyTypeTCP {
+			return fmt.Errorf("TLS termination is only supported for TCP proxies")
+		}
+		tlsConfig, err = h.tlsManager.TerminationConfig(msg.TLSCertName)
+		if err != nil {
+			return err
+		}
+	}
+
+	newProxy := &proxy.ProxyInfo{
+		ProxyType:     msg.ProxyType,
+		LocalPort:     msg.LocalPort,
+		RemotePort:    msg.RemotePort,
+		Name:          msg.Name,
+		ACL:           acl,
+		Limiter:       h.proxyLimiter(msg),
+		TLSConfig:     tlsConfig,
+		TLSCertName:   msg.TLSCertName,
+		Group:         msg.Group,
+		GroupKey:      msg.GroupKey,
+		GroupStrategy: msg.GroupStrategy,
+		Secret:        msg.Secret,
+		Compression:   msg.Compression,
+		PeerAddr:      msg.PeerAddr,
 	}
+	newProxy.SetMaxConnections(int(msg.MaxConns))
+	newProxy.SetPoolSize(h.poolSize(msg))
 
-	switch proxyType {
+	joined, err := h.proxyManager.RegisterProxy(client, newProxy)
+	if err != nil {
+		return err
+	}
+
+	// Group members share the listener started by the first member; secret proxies have none
+	if joined || msg.ProxyType == tunnel.ProxyTypeSTCP {
+		return nil
+	}
+
+	switch msg.ProxyType {
 	case tunnel.ProxyTypeTCP:
-		err = proxy.StartTCPListener(newProxy, client)
+		err = proxy.StartTCPListener(newProxy)
 		if err != nil {
-			log.Printf("Failed to start TCP listener: %v", err)
-			return
+			h.proxyManager.UnregisterGroup(newProxy)
+			return fmt.Errorf("failed to start TCP listener: %w", err)
 		}
 	case tunnel.ProxyTypeUDP:
-		err = proxy.StartUDPListener(newProxy, client)
+		err = proxy.StartUDPListener(newProxy, proxy.UDPSessionConfig{
+			Timeout:     time.Duration(h.serverConfig.UDPSessionTimeout) * time.Second,
+			MaxSessions: h.serverConfig.MaxUDPSessions,
+		})
 		if err != nil {
-			log.Printf("Failed to start UDP listener: %v", err)
-			return
+			h.proxyManager.UnregisterGroup(newProxy)
+			return fmt.Errorf("failed to start UDP listener: %w", err)
+		}
+	}
+	return nil
+}
+
+// HandleStream handles a stream opened by a client after its control stream:
+// a visitor for a secret proxy, a local port forward or a pre-opened work stream
+func (h *Handler) HandleStream(stream *smux.Stream, clientID string) {
+	client := h.proxyManager.GetClient(clientID)
+	if client == nil || !client.Authenticated() {
+		log.Printf("Rejected stream %d from unauthenticated client %s", stream.ID(), clientID)
+		stream.Close()
+		return
+	}
+
+	msgTypeBuf := make([]byte, 1)
+	if _, err := io.ReadFull(stream, msgTypeBuf); err != nil {
+		log.Printf("Failed to read message type on stream %d: %v", stream.ID(), err)
+		stream.Close()
+		return
+	}
+
+	switch msgTypeBuf[0] {
+	case tunnel.MsgTypeVisit:
+		h.handleVisit(stream, clientID)
+	case tunnel.MsgTypeForward:
+		h.handleForward(stream, client)
+	case tunnel.MsgTypeWorkConn:
+		h.handleWorkConn(stream, client)
+	default:
+		log.Printf("Unknown message type on stream %d: 0x%02x", stream.ID(), msgTypeBuf[0])
+		stream.Close()
+	}
+}
+
+// handleVisit splices a visitor's stream to the owner of the secret proxy it names
+func (h *Handler) handleVisit(stream *smux.Stream, clientID string) {
+	msg, err := tunnel.ReadVisit(stream)
+	if err != nil {
+		log.Printf("Invalid visit message: %v", err)
+		stream.Close()
+		return
+	}
+
+	target, err := h.proxyManager.Visit(msg.Name, msg.Secret)
+	if err != nil {
+		log.Printf("Visitor %s denied for proxy %s: %v", clientID, msg.Name, err)
+		_, _ = stream.Write([]byte{tunnel.ReplyDenied})
+		stream.Close()
+		return
+	}
+
+	if _, err := stream.Write([]byte{tunnel.ReplyOK}); err != nil {
+		log.Printf("Failed to accept visitor %s: %v", clientID, err)
+		stream.Close()
+		return
+	}
+
+	proxy.ServeVisitor(stream, target)
+}
+
+// handleForward dials the destination a client forwards a local port to and relays the stream
+func (h *Handler) handleForward(stream *smux.Stream, client *proxy.ClientInfo) {
+	target, err := tunnel.ReadForward(stream)
+	if err != nil {
+		log.Printf("Invalid forward message: %v", err)
+		stream.Close()
+		return
+	}
+
+	h.proxyManager.Forward(stream, client, target)
+}
+
+// handleWorkConn parks a stream the client opened in advance in its proxy's pool
+func (h *Handler) handleWorkConn(stream *smux.Stream, client *proxy.ClientInfo) {
+	name, err := tunnel.ReadWorkConn(stream)
+	if err != nil {
+		log.Printf("Invalid work connection message: %v", err)
+		stream.Close()
+		return
+	}
+
+	p := client.GetProxy(name)
+	if p == nil || !p.AddWorkStream(stream) {
+		log.Printf("No room for work stream %d of proxy %s", stream.ID(), name)
+		stream.Close()
+	}
+}
+
+// handleJoinMsg ties a session to a logical client and answers with a join reply:
+// the primary session announces its run ID and further sessions join it
+func (h *Handler) handleJoinMsg(client *proxy.ClientInfo, ctrlStream *smux.Stream, data []byte) {
+	err := h.join(client, data)
+
+	reply := &tunnel.JoinReplyMsg{Reply: tunnel.ReplyOK}
+	if err != nil {
+		log.Printf("Session %s failed to join: %v", client.ID, err)
+		reply = &tunnel.JoinReplyMsg{Reply: tunnel.ReplyDenied, Error: err.Error()}
+	}
+	if err := tunnel.WriteJoinReply(ctrlStream, reply); err != nil {
+		log.Printf("Failed to answer join of session %s: %v", client.ID, err)
+	}
+}
+
+// join applies a join message to the session's client
+func (h *Handler) join(client *proxy.ClientInfo, data []byte) error {
+	msg, err := tunnel.ParseJoin(data)
+	if err != nil {
+		return err
+	}
+	if msg.RunID == "" {
+		return fmt.Errorf("empty run ID")
+	}
+
+	switch msg.Role {
+	case tunnel.JoinPrimary:
+		if err := h.proxyManager.SetRunID(client, msg.RunID); err != nil {
+			return fmt.Errorf("cannot start a session pool: %w", err)
+		}
+		log.Printf("Client %s accepts further sessions", client.ID)
+	case tunnel.JoinMember:
+		if _, err := h.proxyManager.JoinClient(client.ID, msg.RunID); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown join role %d", msg.Role)
+	}
+	return nil
+}
+
+// handleStatusMsg marks a proxy healthy or unhealthy as reported by its health checks
+func (h *Handler) handleStatusMsg(client *proxy.ClientInfo, data []byte) {
+	msg, err := tunnel.ParseStatus(data)
+	if err != nil {
+		log.Printf("Invalid status message: %v", err)
+		return
+	}
+
+	p := client.GetProxy(msg.Name)
+	if p == nil {
+		log.Printf("Status for unknown proxy %s", msg.Name)
+		return
+	}
+
+	healthy := msg.Status == tunnel.StatusHealthy
+	p.SetHealthy(healthy)
+	log.Printf("Proxy %s reported healthy=%t", msg.Name, healthy)
+}
+
+// accessList combines the proxy's CIDR lists with the server defaults
+func (h *Handler) accessList(msg *tunnel.RegisterMsg) (*proxy.AccessList, error) {
+	allow := msg.AllowCIDRs
+	if len(allow) == 0 {
+		allow = h.serverConfig.AllowCIDRs
+	}
+
+	deny := append([]string{}, h.serverConfig.DenyCIDRs...)
+	deny = append(deny, msg.DenyCIDRs...)
+
+	return proxy.NewAccessList(allow, deny)
+}
+
+// proxyLimiter applies the server's per-proxy cap to the bandwidth requested by the client
+func (h *Handler) proxyLimiter(msg *tunnel.RegisterMsg) *rate.Limiter {
+	limit := int(msg.BandwidthLimit)
+	if max := h.serverConfig.MaxProxyBandwidth; max > 0 && (limit == 0 || limit > max) {
+		limit = max
+	}
+
+	burst := int(msg.BandwidthBurst)
+	if burst == 0 {
+		burst = h.serverConfig.BandwidthBurst
+	}
+
+	// A large burst would let the proxy run at line rate past the cap; allow no
+	// more than the server's own burst, or one second at the capped rate
+	if h.serverConfig.MaxProxyBandwidth > 0 {
+		maxBurst := h.serverConfig.BandwidthBurst
+		if maxBurst <= 0 {
+			maxBurst = limit
 		}
+		if burst > maxBurst {
+			log.Printf("Proxy %s asked for a burst of %d bytes, capped at %d", msg.Name, burst, maxBurst)
+			burst = maxBurst
+		}
+	}
+
+	return proxy.NewBandwidthLimiter(limit, burst)
+}
+
+// poolSize caps the streams the client asked to open in advance at the server's maximum
+func (h *Handler) poolSize(msg *tunnel.RegisterMsg) int {
+	// UDP peers keep their own long-lived streams
+	if msg.ProxyType == tunnel.ProxyTypeUDP {
+		return 0
 	}
 
-	// TODO: Send back success response
+	max := h.serverConfig.MaxPoolCount
+	if max <= 0 {
+		max = proxy.DefaultMaxPoolCount
+	}
+	if int64(msg.PoolCount) > int64(max) {
+		log.Printf("Proxy %s asked for %d pooled streams, capped at %d", msg.Name, msg.PoolCount, max)
+		return max
+	}
+	return int(msg.PoolCount)
+}
+
+// tokenLimiter returns the bandwidth limiter shared by all clients using token
+func (h *Handler) tokenLimiter(token string) *rate.Limiter {
+	if h.serverConfig.MaxTokenBandwidth <= 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	limiter, exists := h.tokenLimiters[token]
+	if !exists {
+		limiter = proxy.NewBandwidthLimiter(h.serverConfig.MaxTokenBandwidth, h.serverConfig.BandwidthBurst)
+		h.tokenLimiters[token] = limiter
+	}
+	return limiter
 }
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"testing"
+
+	"github.com/markCwatson/mgrok/internal/config"
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+func TestProxyLimiterBurst(t *testing.T) {
+	const mib = 1 << 20
+
+	tests := []struct {
+		name   string
+		server config.ServerConfig
+		limit  uint32
+		burst  uint32
+		want   int
+	}{
+		{"oversized burst clamped to the capped rate", config.ServerConfig{MaxProxyBandwidth: mib}, 4 * mib, 1<<32 - 1, mib},
+		{"oversized burst clamped to the server burst", config.ServerConfig{MaxProxyBandwidth: mib, BandwidthBurst: 2 * mib}, mib, 1<<32 - 1, 2 * mib},
+		{"burst within the server burst is kept", config.ServerConfig{MaxProxyBandwidth: mib, BandwidthBurst: 4 * mib}, mib, 3 * mib, 3 * mib},
+		{"no server cap keeps the client's burst", config.ServerConfig{}, mib, 8 * mib, 8 * mib},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{serverConfig: &tt.server}
+			limiter := h.proxyLimiter(&tunnel.RegisterMsg{Name: "web", BandwidthLimit: tt.limit, BandwidthBurst: tt.burst})
+			if got := limiter.Burst(); got != tt.want {
+				t.Fatalf("got burst %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AccessList decides which remote addresses may use a proxy
+// An empty allow list allows everything that is not denied
+type AccessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewAccessList parses allow and deny entries into an AccessList
+// Entries may be CIDRs ("10.0.0.0/8") or single addresses ("192.168.1.10")
+func NewAccessList(allow, deny []string) (*AccessList, error) {
+	var err error
+	acl := &AccessList{}
+
+	acl.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+
+	acl.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+
+	return acl, nil
+}
+
+// Allowed reports whether addr may connect; deny entries take precedence over allow entries
+func (a *AccessList) Allowed(addr net.Addr) bool {
+	if a == nil || (len(a.allow) == 0 && len(a.deny) == 0) {
+		return true
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true
+	}
+
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Equal reports whether a and b allow and deny the same networks, in any order
+func (a *AccessList) Equal(b *AccessList) bool {
+	return sameNets(a.nets(false), b.nets(false)) && sameNets(a.nets(true), b.nets(true))
+}
+
+func (a *AccessList) nets(deny bool) []*net.IPNet {
+	switch {
+	case a == nil:
+		return nil
+	case deny:
+		return a.deny
+	}
+	return a.allow
+}
+
+func sameNets(x, y []*net.IPNet) bool {
+	count := make(map[string]int)
+	for _, n := range x {
+		count[n.String()]++
+	}
+	for _, n := range y {
+		count[n.String()]--
+	}
+	for _, c := range count {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrIP extracts the IP from a TCP or UDP address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
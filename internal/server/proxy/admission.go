@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Admission policies for connections that arrive while a limit is reached
+	PolicyReject = "reject"
+	PolicyQueue  = "queue"
+
+	defaultQueueTimeout = 10 * time.Second
+	defaultMaxQueue     = 256
+
+	// per-IP limiters unused for this long are forgotten
+	ipLimiterIdle = time.Minute
+)
+
+// AdmissionConfig controls how many connections the public listeners accept
+type AdmissionConfig struct {
+	MaxStreamsPerSession int           // Concurrent data streams per client session (0 means unlimited)
+	AcceptRatePerIP      float64       // New connections per second from one source IP (0 means unlimited)
+	AcceptBurstPerIP     int           // Connections one source IP may open at once before AcceptRatePerIP applies
+	Policy               string        // PolicyReject or PolicyQueue
+	QueueTimeout         time.Duration // How long a queued connection waits for a free slot
+	MaxQueue             int           // Connections that may wait at once; further ones are rejected
+}
+
+// admission enforces an AdmissionConfig; it is shared by all clients of a Manager
+type admission struct {
+	cfg AdmissionConfig
+
+	ipLimiters map[string]*ipLimiter
+	lastSweep  time.Time
+	mu         sync.Mutex
+
+	queued atomic.Int64 // Connections currently waiting for a slot
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newAdmission(cfg AdmissionConfig) *admission {
+	if cfg.Policy == "" {
+		cfg.Policy = PolicyReject
+	}
+	if cfg.Policy == PolicyQueue && cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = defaultQueueTimeout
+	}
+	if cfg.MaxQueue <= 0 {
+		cfg.MaxQueue = defaultMaxQueue
+	}
+	if cfg.AcceptBurstPerIP < 1 {
+		cfg.AcceptBurstPerIP = 1
+	}
+
+	return &admission{
+		cfg:        cfg,
+		ipLimiters: make(map[string]*ipLimiter),
+		lastSweep:  time.Now(),
+	}
+}
+
+// allowIP reports whether the source address is within its accept rate
+func (a *admission) allowIP(addr net.Addr) bool {
+	if a.cfg.AcceptRatePerIP <= 0 {
+		return true
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	key := ip.String()
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastSweep) > ipLimiterIdle {
+		for k, l := range a.ipLimiters {
+			if now.Sub(l.lastSeen) > ipLimiterIdle {
+				delete(a.ipLimiters, k)
+			}
+		}
+		a.lastSweep = now
+	}
+
+	l, exists := a.ipLimiters[key]
+	if !exists {
+		l = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(a.cfg.AcceptRatePerIP), a.cfg.AcceptBurstPerIP)}
+		a.ipLimiters[key] = l
+	}
+	l.lastSeen = now
+
+	return l.limiter.AllowN(now, 1)
+}
+
+// acquire takes a slot from each semaphore (nil semaphores are unlimited),
+// either immediately or, if queue is set and fewer than MaxQueue connections
+// are waiting, waiting up to QueueTimeout. On success the returned func gives
+// the slots back.
+func (a *admission) acquire(queue bool, sems ...chan struct{}) (func(), bool) {
+	var timeout <-chan time.Time
+	if queue {
+		timer := time.NewTimer(a.cfg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var taken []chan struct{}
+	release := func() {
+		for _, sem := range taken {
+			<-sem
+		}
+	}
+
+	waiting := false
+	defer func() {
+		if waiting {
+			a.queued.Add(-1)
+		}
+	}()
+
+	for _, sem := range sems {
+		if sem == nil {
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+			taken = append(taken, sem)
+			continue
+		default:
+		}
+
+		// Every waiting connection holds a goroutine and a socket, so the queue is bounded
+		if queue && (waiting || a.enqueue()) {
+			waiting = true
+			select {
+			case sem <- struct{}{}:
+				taken = append(taken, sem)
+				continue
+			case <-timeout:
+			}
+		}
+
+		release()
+		return nil, false
+	}
+
+	return release, true
+}
+
+// enqueue reserves a place in the wait queue, reporting false when it is full
+func (a *admission) enqueue() bool {
+	if a.queued.Add(1) > int64(a.cfg.MaxQueue) {
+		a.queued.Add(-1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst keeps a full UDP datagram within a single bucket reservation
+const minBurst = 65535
+
+// NewBandwidthLimiter creates a token bucket limiting throughput to bytesPerSec
+// with room for a burst of burst bytes. Returns nil (unlimited) if bytesPerSec <= 0.
+func NewBandwidthLimiter(bytesPerSec, burst int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	if burst < bytesPerSec {
+		burst = bytesPerSec
+	}
+	if burst < minBurst {
+		burst = minBurst
+	}
+
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// bandwidth is the chain of token buckets (proxy, client, token) that traffic for
+// a proxy must pass through
+type bandwidth struct {
+	limiters  []*rate.Limiter
+	throttled *atomic.Uint64
+}
+
+func newBandwidth(client *ClientInfo, proxy *ProxyInfo) *bandwidth {
+	b := &bandwidth{throttled: &proxy.Stats.Throttled}
+	for _, l := range []*rate.Limiter{proxy.Limiter, client.Limiter, client.TokenLimiter} {
+		if l != nil {
+			b.limiters = append(b.limiters, l)
+		}
+	}
+	return b
+}
+
+// chunk returns the largest write that fits in every bucket
+func (b *bandwidth) chunk(n int) int {
+	for _, l := range b.limiters {
+		if burst := l.Burst(); burst < n {
+			n = burst
+		}
+	}
+	return n
+}
+
+// wait blocks until n bytes may pass through every bucket; n must not exceed chunk(n)
+func (b *bandwidth) wait(n int) {
+	var delay time.Duration
+	now := time.Now()
+	for _, l := range b.limiters {
+		if d := l.ReserveN(now, n).DelayFrom(now); d > delay {
+			delay = d
+		}
+	}
+
+	if delay > 0 {
+		b.throttled.Add(1)
+		time.Sleep(delay)
+	}
+}
+
+// meteredWriter counts bytes written to w and applies the bandwidth limits
+type meteredWriter struct {
+	w       io.Writer
+	bw      *bandwidth
+	counter *atomic.Uint64
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if len(m.bw.limiters) > 0 {
+			n = m.bw.chunk(n)
+			m.bw.wait(n)
+		}
+
+		nw, err := m.w.Write(p[:n])
+		written += nw
+		m.counter.Add(uint64(nw))
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
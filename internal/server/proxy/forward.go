@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+)
+
+// forwardDialTimeout bounds how long the server waits for a forward target to accept
+const forwardDialTimeout = 10 * time.Second
+
+// ErrForwardDenied is returned for targets that are not in the allowlist
+var ErrForwardDenied = errors.New("target not allowed")
+
+// forwardRule is one allowlist entry: a hostname or a network, on one port or any port
+type forwardRule struct {
+	host string     // Matched by name; empty for network rules
+	net  *net.IPNet // Matched by resolved address
+	port int        // 0 matches any port
+}
+
+// ForwardAllowlist decides which destinations clients may reach through the
+// server with local port forwarding. An empty allowlist disables forwarding.
+type ForwardAllowlist struct {
+	rules []forwardRule
+}
+
+// NewForwardAllowlist parses entries such as "staging.internal", "db.internal:5432",
+// "10.0.0.0/8" or "[fd00::/8]:22"; an entry without a port allows every port
+func NewForwardAllowlist(entries []string) (*ForwardAllowlist, error) {
+	a := &ForwardAllowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var rule forwardRule
+		host := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			port, err := strconv.Atoi(p)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid port in forward target %q", entry)
+			}
+			host, rule.port = h, port
+		}
+
+		if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+			nets, err := parseCIDRs([]string{host})
+			if err != nil {
+				return nil, fmt.Errorf("invalid forward target %q: %w", entry, err)
+			}
+			rule.net = nets[0]
+		} else {
+			rule.host = strings.ToLower(host)
+		}
+
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+// Enabled reports whether any forward target is allowed
+func (a *ForwardAllowlist) Enabled() bool {
+	return a != nil && len(a.rules) > 0
+}
+
+// Dial connects to target if the allowlist permits it. Hostnames that are not
+// allowed by name are resolved and an allowed address is dialed, so DNS cannot
+// send the connection somewhere else.
+func (a *ForwardAllowlist) Dial(target string) (net.Conn, error) {
+	if !a.Enabled() {
+		return nil, fmt.Errorf("forwarding is disabled: %w", ErrForwardDenied)
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, ErrForwardDenied)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid target %q: %w", target, ErrForwardDenied)
+	}
+
+	for _, rule := range a.rules {
+		if rule.host != "" && rule.host == strings.ToLower(host) && (rule.port == 0 || rule.port == port) {
+			return net.DialTimeout("tcp", target, forwardDialTimeout)
+		}
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if a.ipAllowed(ip, port) {
+			return net.DialTimeout("tcp", net.JoinHostPort(ip.String(), portStr), forwardDialTimeout)
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", target, ErrForwardDenied)
+}
+
+func (a *ForwardAllowlist) ipAllowed(ip net.IP, port int) bool {
+	for _, rule := range a.rules {
+		if rule.net != nil && rule.net.Contains(ip) && (rule.port == 0 || rule.port == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeForward dials target for a client's forward stream, answers the client
+// and relays the stream, counting it against the client's bandwidth and stream limits
+func ServeForward(conn net.Conn, client *ClientInfo, allowlist *ForwardAllowlist, target string) {
+	defer conn.Close()
+
+	release, ok := client.admission.acquire(client.admission.cfg.Policy == PolicyQueue, client.streams)
+	if !ok {
+		log.Printf("Rejected forward to %s for client %s (stream limit reached)", target, client.ID)
+		_, _ = conn.Write([]byte{tunnel.ReplyFailed})
+		return
+	}
+	defer release()
+
+	targetConn, err := allowlist.Dial(target)
+	if err != nil {
+		log.Printf("Forward to %s for client %s failed: %v", target, client.ID, err)
+		reply := byte(tunnel.ReplyFailed)
+		if errors.Is(err, ErrForwardDenied) {
+			reply = tunnel.ReplyDenied
+		}
+		_, _ = conn.Write([]byte{reply})
+		return
+	}
+	defer targetConn.Close()
+
+	if _, err := conn.Write([]byte{tunnel.ReplyOK}); err != nil {
+		log.Printf("Failed to accept forward for client %s: %v", client.ID, err)
+		return
+	}
+
+	log.Printf("Forwarding client %s to %s (%s)", client.ID, target, targetConn.RemoteAddr())
+
+	var in, out, throttled atomic.Uint64
+	bw := &bandwidth{throttled: &throttled}
+	if client.Limiter != nil {
+		bw.limiters = append(bw.limiters, client.Limiter)
+	}
+	if client.TokenLimiter != nil {
+		bw.limiters = append(bw.limiters, client.TokenLimiter)
+	}
+
+	go func() {
+		// stream/client -> target
+		_, _ = io.Copy(&meteredWriter{w: targetConn, bw: bw, counter: &in}, conn)
+		targetConn.Close()
+	}()
+
+	// target -> stream/client
+	_, _ = io.Copy(&meteredWriter{w: conn, bw: bw, counter: &out}, targetConn)
+
+	log.Printf("Forward to %s for client %s closed (in=%d out=%d)", target, client.ID, in.Load(), out.Load())
+}
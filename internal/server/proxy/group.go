@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	// Load balancing strategies for proxy groups
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+)
+
+// ProxyGroup is the set of proxies, possibly from several clients, that share
+// one public port. A proxy registered without a group name gets a group of its own.
+type ProxyGroup struct {
+	Name     string // Empty for a proxy that is not part of a named group
+	Key      string
+	Strategy string
+	Listener net.Listener // Only used for TCP proxies
+	UDPConn  *net.UDPConn // Only used for UDP proxies
+
+	label   string // Used in logs: the group name, or the proxy name for ungrouped proxies
+	members []*ProxyInfo
+
+	// Set by the first member; the shared listener applies them to every member
+	tlsTermination bool
+	tlsCertName    string
+	acl            *AccessList
+
+	next int
+	mu   sync.Mutex
+}
+
+func newProxyGroup(proxy *ProxyInfo) *ProxyGroup {
+	g := &ProxyGroup{
+		Name:     proxy.Group,
+		Key:      proxy.GroupKey,
+		Strategy: proxy.GroupStrategy,
+		label:    proxy.Name,
+
+		tlsTermination: proxy.TLSConfig != nil,
+		tlsCertName:    proxy.TLSCertName,
+		acl:            proxy.ACL,
+	}
+	if g.Name != "" {
+		g.label = "group " + g.Name
+	}
+	if g.Strategy != StrategyLeastConn {
+		g.Strategy = StrategyRoundRobin
+	}
+	return g
+}
+
+// compatible checks that proxy treats public users the way the group's first
+// member does, since all members share one listener
+func (g *ProxyGroup) compatible(proxy *ProxyInfo) error {
+	if (proxy.TLSConfig != nil) != g.tlsTermination || proxy.TLSCertName != g.tlsCertName {
+		return fmt.Errorf("group %s uses different tls_termination settings", g.Name)
+	}
+	if !proxy.ACL.Equal(g.acl) {
+		return fmt.Errorf("group %s uses different allow and deny lists", g.Name)
+	}
+	return nil
+}
+
+// pick chooses the healthy member that should handle a new connection; nil if there is none
+func (g *ProxyGroup) pick() *ProxyInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Strategy == StrategyLeastConn {
+		var best *ProxyInfo
+		for _, p := range g.members {
+			if !p.Healthy() {
+				continue
+			}
+			if best == nil || p.Stats.Active.Load() < best.Stats.Active.Load() {
+				best = p
+			}
+		}
+		return best
+	}
+
+	for range g.members {
+		g.next = (g.next + 1) % len(g.members)
+		if p := g.members[g.next]; p.Healthy() {
+			return p
+		}
+	}
+	return nil
+}
+
+func (g *ProxyGroup) add(proxy *ProxyInfo) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.members = append(g.members, proxy)
+}
+
+// remove drops proxy from the group and reports whether the group is now empty
+func (g *ProxyGroup) remove(proxy *ProxyInfo) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, p := range g.members {
+		if p == proxy {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+// close stops the group's public listener
+func (g *ProxyGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Listener != nil {
+		g.Listener.Close()
+	}
+	if g.UDPConn != nil {
+		g.UDPConn.Close()
+	}
+	log.Printf("Closed public port for %s", g.label)
+}
@@ -1,22 +1,67 @@
 package proxy
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 
+	"github.com/markCwatson/mgrok/internal/tunnel"
 	"github.com/xtaci/smux"
+	"golang.org/x/time/rate"
 )
 
 // ProxyInfo stores information about a registered proxy
 type ProxyInfo struct {
-	ProxyType  uint8
-	LocalPort  uint16
-	RemotePort uint16
-	Name       string
-	Listener   net.Listener // Only used for TCP proxies
-	UDPConn    *net.UDPConn // Only used for UDP proxies
+	ProxyType   uint8
+	LocalPort   uint16
+	RemotePort  uint16
+	Name        string
+	Client      *ClientInfo   // Client that registered the proxy
+	ACL         *AccessList   // Remote addresses allowed to use this proxy
+	Limiter     *rate.Limiter // Bandwidth limit for this proxy (nil means unlimited)
+	TLSConfig   *tls.Config   // Set when the server terminates TLS for this proxy
+	TLSCertName string        // Certificate TLSConfig was built for (empty for the default)
+	Stats       ProxyStats
+
+	// Proxies with the same group name and key share one public port
+	Group         string
+	GroupKey      string
+	GroupStrategy string // StrategyRoundRobin or StrategyLeastConn, set by the first member
+
+	Secret string // Visitors must present this to reach an STCP proxy
+
+	Compression string // Algorithm for data streams to the client (empty means none)
+
+	PeerAddr bool // Send the public peer's address after NewStream
+
+	group     *ProxyGroup
+	slots     chan struct{} // Concurrent connection limit (nil means unlimited)
+	unhealthy atomic.Bool   // Set while the client reports the local service as down
+
+	pool       chan *smux.Stream // Idle streams the client opened in advance (nil means no pool)
+	poolClosed bool
+	poolMu     sync.Mutex
+}
+
+// Healthy reports whether the proxy's local service is up according to the client
+func (p *ProxyInfo) Healthy() bool {
+	return !p.unhealthy.Load()
+}
+
+// SetHealthy records the health reported by the client
+func (p *ProxyInfo) SetHealthy(healthy bool) {
+	p.unhealthy.Store(!healthy)
+}
+
+// SetMaxConnections limits how many connections the proxy forwards at once
+func (p *ProxyInfo) SetMaxConnections(max int) {
+	if max > 0 {
+		p.slots = make(chan struct{}, max)
+	}
 }
 
 // ClientInfo stores information about a connected client
@@ -26,33 +71,155 @@ type ClientInfo struct {
 	Session    *smux.Session
 	Proxies    map[string]*ProxyInfo
 	CtrlStream *smux.Stream
-	mu         sync.Mutex
+	// Bandwidth limits shared by all proxies of this client, and by all clients using the same token
+	Limiter      *rate.Limiter
+	TokenLimiter *rate.Limiter
+
+	// With pool_size the client runs several sessions: Session carries control,
+	// and data streams are spread over all of them
+	RunID       string
+	sessions    []*smux.Session
+	members     map[string]*smux.Session // Joined sessions by their own client ID
+	nextSession int
+
+	admission     *admission
+	streams       chan struct{} // Concurrent data stream limit for the client (nil means unlimited)
+	authenticated atomic.Bool
+	joined        atomic.Bool // Set on a session that joined another client; it only carries data streams
+	mu            sync.Mutex
+}
+
+// Authenticated reports whether the client has completed the handshake
+func (c *ClientInfo) Authenticated() bool {
+	return c.authenticated.Load()
+}
+
+// SetAuthenticated records that the client has completed the handshake
+func (c *ClientInfo) SetAuthenticated() {
+	c.authenticated.Store(true)
+}
+
+// Joined reports whether this session has joined another client's session pool
+func (c *ClientInfo) Joined() bool {
+	return c.joined.Load()
+}
+
+// GetProxy gets one of the client's proxies by name
+func (c *ClientInfo) GetProxy(name string) *ProxyInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Proxies[name]
+}
+
+// admit applies the admission policy before a new data stream is opened for proxy.
+// On success the returned func must be called once the stream is done.
+func (c *ClientInfo) admit(proxy *ProxyInfo) (func(), bool) {
+	return c.acquire(proxy, c.admission.cfg.Policy == PolicyQueue)
+}
+
+// tryAdmit is like admit but never queues; used where waiting would stall other traffic
+func (c *ClientInfo) tryAdmit(proxy *ProxyInfo) (func(), bool) {
+	return c.acquire(proxy, false)
+}
+
+func (c *ClientInfo) acquire(proxy *ProxyInfo, queue bool) (func(), bool) {
+	release, ok := c.admission.acquire(queue, proxy.slots, c.streams)
+	if !ok {
+		proxy.Stats.Rejected.Add(1)
+	}
+	return release, ok
+}
+
+// portKey identifies a public port; TCP and UDP ports are separate namespaces
+type portKey struct {
+	network uint8 // tunnel.ProxyTypeTCP or tunnel.ProxyTypeUDP
+	port    uint16
+}
+
+func newPortKey(proxyType uint8, port uint16) portKey {
+	if proxyType == tunnel.ProxyTypeUDP {
+		return portKey{network: tunnel.ProxyTypeUDP, port: port}
+	}
+	return portKey{network: tunnel.ProxyTypeTCP, port: port}
+}
+
+func (k portKey) String() string {
+	if k.network == tunnel.ProxyTypeUDP {
+		return fmt.Sprintf("udp/%d", k.port)
+	}
+	return fmt.Sprintf("tcp/%d", k.port)
 }
 
 // Manager manages all registered proxies
 type Manager struct {
 	clients     map[string]*ClientInfo
-	portToProxy map[uint16]*ProxyInfo
+	portToGroup map[portKey]*ProxyGroup
+	admission   *admission
 	mu          sync.Mutex
+
+	// STCP proxies by name; they have no port
+	secretProxies map[string]*ProxyInfo
+
+	// Destinations clients may reach with local port forwarding
+	forwards *ForwardAllowlist
+
+	// Clients running several sessions, by run ID
+	runs map[string]*ClientInfo
 }
 
 // NewManager creates a new proxy manager
 func NewManager() *Manager {
 	return &Manager{
 		clients:     make(map[string]*ClientInfo),
-		portToProxy: make(map[uint16]*ProxyInfo),
+		portToGroup: make(map[portKey]*ProxyGroup),
+		admission:   newAdmission(AdmissionConfig{}),
+
+		secretProxies: make(map[string]*ProxyInfo),
+		runs:          make(map[string]*ClientInfo),
 	}
 }
 
+// SetAdmission sets the admission limits for clients added from now on
+func (m *Manager) SetAdmission(cfg AdmissionConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.admission = newAdmission(cfg)
+}
+
+// SetForwardAllowlist sets the destinations clients may reach with local port forwarding
+func (m *Manager) SetForwardAllowlist(allowlist *ForwardAllowlist) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forwards = allowlist
+}
+
+// Forward relays a client's forward stream to target if the allowlist permits it
+func (m *Manager) Forward(conn net.Conn, client *ClientInfo, target string) {
+	m.mu.Lock()
+	allowlist := m.forwards
+	m.mu.Unlock()
+
+	ServeForward(conn, client, allowlist, target)
+}
+
 // AddClient adds a new client to the manager
 func (m *Manager) AddClient(clientID string, session *smux.Session) *ClientInfo {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	client := &ClientInfo{
-		ID:      clientID,
-		Session: session,
-		Proxies: make(map[string]*ProxyInfo),
+		ID:        clientID,
+		Session:   session,
+		Proxies:   make(map[string]*ProxyInfo),
+		sessions:  []*smux.Session{session},
+		members:   make(map[string]*smux.Session),
+		admission: m.admission,
+	}
+	if max := m.admission.cfg.MaxStreamsPerSession; max > 0 {
+		client.streams = make(chan struct{}, max)
 	}
 
 	m.clients[clientID] = client
@@ -69,22 +236,33 @@ func (m *Manager) RemoveClient(clientID string) {
 		return
 	}
 
+	// A joined session going away leaves the client and its other sessions running
+	if client.ID != clientID {
+		m.leaveLocked(client, clientID)
+		return
+	}
+
 	// Clean up all listeners for this client
 	for _, proxy := range client.Proxies {
-		if proxy.Listener != nil {
-			proxy.Listener.Close()
-		}
-		if proxy.UDPConn != nil {
-			proxy.UDPConn.Close()
-		}
-		delete(m.portToProxy, proxy.RemotePort)
+		m.unregisterLocked(client, proxy)
+	}
+
+	// The joined sessions have no control stream of their own, so they end with the client
+	client.mu.Lock()
+	for memberID, session := range client.members {
+		delete(m.clients, memberID)
+		session.Close()
+	}
+	client.mu.Unlock()
+	if client.RunID != "" {
+		delete(m.runs, client.RunID)
 	}
 
 	delete(m.clients, clientID)
 	log.Printf("Client %s disconnected, cleaned up resources", clientID)
 }
 
-// GetClient gets a client by ID
+// GetClient gets a client by ID; the ID of a joined session returns the client it joined
 func (m *Manager) GetClient(clientID string) *ClientInfo {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -92,57 +270,129 @@ func (m *Manager) GetClient(clientID string) *ClientInfo {
 	return m.clients[clientID]
 }
 
-// IsPortAvailable checks if a port is available
-func (m *Manager) IsPortAvailable(port uint16) bool {
+// IsPortAvailable checks if a port is available for the given proxy type
+func (m *Manager) IsPortAvailable(proxyType uint8, port uint16) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	_, exists := m.portToProxy[port]
+	_, exists := m.portToGroup[newPortKey(proxyType, port)]
 	return !exists
 }
 
-// RegisterProxy registers a new proxy
-func (m *Manager) RegisterProxy(client *ClientInfo, name string, proxyType uint8, remotePort, localPort uint16) (*ProxyInfo, error) {
+// RegisterProxy registers a new proxy. A proxy that names a group may join the
+// group already using its port if the group key matches; joined is then true and
+// the caller must not start another listener.
+func (m *Manager) RegisterProxy(client *ClientInfo, proxy *ProxyInfo) (joined bool, err error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Check if port is already in use
-	if _, exists := m.portToProxy[remotePort]; exists {
-		return nil, fmt.Errorf("port %d already in use", remotePort)
+	if proxy.ProxyType == tunnel.ProxyTypeSTCP {
+		return false, m.registerSecretLocked(client, proxy)
 	}
 
-	// Create proxy info
-	proxy := &ProxyInfo{
-		ProxyType:  proxyType,
-		LocalPort:  localPort,
-		RemotePort: remotePort,
-		Name:       name,
+	// Check if port is already in use
+	key := newPortKey(proxy.ProxyType, proxy.RemotePort)
+	group, exists := m.portToGroup[key]
+	if exists {
+		if proxy.Group == "" || group.Name != proxy.Group {
+			return false, fmt.Errorf("port %s already in use", key)
+		}
+		if subtle.ConstantTimeCompare([]byte(group.Key), []byte(proxy.GroupKey)) != 1 {
+			return false, fmt.Errorf("invalid key for group %s", proxy.Group)
+		}
+		if err := group.compatible(proxy); err != nil {
+			return false, err
+		}
+		if group.Strategy != proxy.GroupStrategy && proxy.GroupStrategy != "" {
+			log.Printf("Proxy %s asked for strategy %s, group %s keeps %s",
+				proxy.Name, proxy.GroupStrategy, group.Name, group.Strategy)
+		}
+	} else {
+		group = newProxyGroup(proxy)
+		m.portToGroup[key] = group
 	}
 
+	proxy.Client = client
+	proxy.group = group
+	group.add(proxy)
+
 	// Store the proxy
 	client.mu.Lock()
-	client.Proxies[name] = proxy
+	client.Proxies[proxy.Name] = proxy
 	client.mu.Unlock()
 
-	m.portToProxy[remotePort] = proxy
+	if exists {
+		log.Printf("Proxy %s joined %s on port %s", proxy.Name, group.label, key)
+	} else {
+		log.Printf("Registered proxy %s on port %s", proxy.Name, key)
+	}
+	return exists, nil
+}
 
-	log.Printf("Registered proxy %s on port %d", name, remotePort)
-	return proxy, nil
+// UnregisterGroup removes every member of proxy's group and releases its port.
+// Used when the group's listener fails to start, since other members may
+// already have joined the group; their clients are told the proxy was removed.
+func (m *Manager) UnregisterGroup(proxy *ProxyInfo) {
+	m.mu.Lock()
+
+	if proxy.group == nil {
+		m.unregisterLocked(proxy.Client, proxy)
+		m.mu.Unlock()
+		return
+	}
+
+	proxy.group.mu.Lock()
+	members := append([]*ProxyInfo{}, proxy.group.members...)
+	proxy.group.mu.Unlock()
+
+	for _, member := range members {
+		m.unregisterLocked(member.Client, member)
+	}
+	m.mu.Unlock()
+
+	// The caller answers its own client's registration with the error
+	for _, member := range members {
+		if member.Client == proxy.Client || member.Client.CtrlStream == nil {
+			continue
+		}
+		log.Printf("Removed proxy %s of client %s from %s", member.Name, member.Client.ID, proxy.group.label)
+		if err := tunnel.WriteStatus(member.Client.CtrlStream, member.Name, tunnel.StatusRemoved); err != nil {
+			log.Printf("Failed to tell client %s that proxy %s was removed: %v", member.Client.ID, member.Name, err)
+		}
+	}
 }
 
-// closes all proxy TCP listeners
+func (m *Manager) unregisterLocked(client *ClientInfo, proxy *ProxyInfo) {
+	client.mu.Lock()
+	if client.Proxies[proxy.Name] == proxy {
+		delete(client.Proxies, proxy.Name)
+	}
+	client.mu.Unlock()
+
+	proxy.closeWorkStreams()
+
+	if proxy.ProxyType == tunnel.ProxyTypeSTCP && m.secretProxies[proxy.Name] == proxy {
+		delete(m.secretProxies, proxy.Name)
+	}
+
+	if proxy.group == nil || !proxy.group.remove(proxy) {
+		return
+	}
+
+	proxy.group.close()
+	key := newPortKey(proxy.ProxyType, proxy.RemotePort)
+	if m.portToGroup[key] == proxy.group {
+		delete(m.portToGroup, key)
+	}
+}
+
+// closes all proxy TCP listeners and UDP sockets and releases their ports
 func (m *Manager) CloseAllListeners() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for _, client := range m.clients {
-		for _, proxy := range client.Proxies {
-			if proxy.Listener != nil {
-				proxy.Listener.Close()
-			}
-			if proxy.UDPConn != nil {
-				proxy.UDPConn.Close()
-			}
-		}
+	for key, group := range m.portToGroup {
+		group.close()
+		delete(m.portToGroup, key)
 	}
 }
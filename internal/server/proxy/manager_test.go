@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
+)
+
+// groupMember returns a proxy that joins group "web" on port 8080
+func groupMember(t *testing.T, name string, allow []string) *ProxyInfo {
+	t.Helper()
+
+	acl, err := NewAccessList(allow, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ProxyInfo{
+		ProxyType:  tunnel.ProxyTypeTCP,
+		RemotePort: 8080,
+		Name:       name,
+		ACL:        acl,
+		Group:      "web",
+		GroupKey:   "key",
+	}
+}
+
+func TestGroupJoinNeedsSameSettings(t *testing.T) {
+	m := NewManager()
+	first := m.AddClient("first", nil)
+	if _, err := m.RegisterProxy(first, groupMember(t, "a", []string{"10.0.0.0/8", "192.168.1.10"})); err != nil {
+		t.Fatal(err)
+	}
+
+	withTLS := groupMember(t, "tls", []string{"10.0.0.0/8", "192.168.1.10"})
+	withTLS.TLSConfig = &tls.Config{}
+
+	tests := []struct {
+		name    string
+		proxy   *ProxyInfo
+		wantErr string
+	}{
+		{name: "same lists in another order", proxy: groupMember(t, "b", []string{"192.168.1.10/32", "10.0.0.0/8"})},
+		{name: "other allow list", proxy: groupMember(t, "c", []string{"10.0.0.0/8"}), wantErr: "allow and deny"},
+		{name: "tls termination", proxy: withTLS, wantErr: "tls_termination"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			joined, err := m.RegisterProxy(m.AddClient(tt.name, nil), tt.proxy)
+			if tt.wantErr == "" {
+				if err != nil || !joined {
+					t.Fatalf("got joined=%t, %v; want the proxy to join", joined, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnregisterGroupTellsOtherClients(t *testing.T) {
+	c1, c2 := net.Pipe()
+	serverSession, err := smux.Server(c1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSession, err := smux.Client(c2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		serverSession.Close()
+		clientSession.Close()
+	})
+
+	// The control stream of the client whose member gets removed
+	clientCtrl, err := clientSession.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCtrl, err := serverSession.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManager()
+	first := groupMember(t, "a", nil)
+	if _, err := m.RegisterProxy(m.AddClient("first", nil), first); err != nil {
+		t.Fatal(err)
+	}
+	other := m.AddClient("other", serverSession)
+	other.CtrlStream = serverCtrl
+	if _, err := m.RegisterProxy(other, groupMember(t, "b", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first member's listener failed to start
+	m.UnregisterGroup(first)
+
+	if other.GetProxy("b") != nil {
+		t.Fatal("proxy b is still registered")
+	}
+	clientCtrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := tunnel.ReadControl(clientCtrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg[0] != tunnel.MsgTypeStatus {
+		t.Fatalf("got message type 0x%02x, want a status", msg[0])
+	}
+	status, err := tunnel.ParseStatus(msg[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "b" || status.Status != tunnel.StatusRemoved {
+		t.Fatalf("got status %d for %s, want removed for b", status.Status, status.Name)
+	}
+}
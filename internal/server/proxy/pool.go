@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"log"
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// DefaultMaxPoolCount caps the streams a client may keep open in advance for one proxy
+const DefaultMaxPoolCount = 10
+
+// SetPoolSize lets the client park up to size pre-opened streams for the proxy
+func (p *ProxyInfo) SetPoolSize(size int) {
+	if size > 0 {
+		p.pool = make(chan *smux.Stream, size)
+	}
+}
+
+// AddWorkStream parks a stream the client opened in advance. It reports false,
+// and the caller should close the stream, when the proxy has no room for it.
+func (p *ProxyInfo) AddWorkStream(stream *smux.Stream) bool {
+	p.poolMu.Lock()
+	defer p.poolMu.Unlock()
+
+	if p.pool == nil || p.poolClosed {
+		return false
+	}
+
+	select {
+	case p.pool <- stream:
+		return true
+	default:
+		return false
+	}
+}
+
+// takeWorkStream returns an idle pre-opened stream, or nil when the pool is empty
+func (p *ProxyInfo) takeWorkStream() *smux.Stream {
+	select {
+	case stream := <-p.pool:
+		return stream
+	default:
+		return nil
+	}
+}
+
+// closeWorkStreams closes the idle streams and refuses new ones once the proxy is gone
+func (p *ProxyInfo) closeWorkStreams() {
+	p.poolMu.Lock()
+	defer p.poolMu.Unlock()
+
+	p.poolClosed = true
+	for {
+		stream := p.takeWorkStream()
+		if stream == nil {
+			return
+		}
+		stream.Close()
+	}
+}
+
+// openDataStream returns a stream to the client on which NewStream has been sent
+// for proxy, taking a pre-opened one when available
+func openDataStream(client *ClientInfo, proxy *ProxyInfo, peer net.Addr) (*smux.Stream, error) {
+	if proxy.pool != nil {
+		for stream := proxy.takeWorkStream(); stream != nil; stream = proxy.takeWorkStream() {
+			if err := writeNewStream(stream, proxy, peer); err != nil {
+				// The client may have closed it already; try the next one
+				stream.Close()
+				continue
+			}
+			proxy.Stats.PoolHits.Add(1)
+			return stream, nil
+		}
+		proxy.Stats.PoolMisses.Add(1)
+		log.Printf("Stream pool for proxy %s is empty, opening a new stream", proxy.Name)
+	}
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeNewStream(stream, proxy, peer); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/xtaci/smux"
+)
+
+// OpenStream opens a stream to the client, spreading streams across its
+// sessions and skipping sessions that have died
+func (c *ClientInfo) OpenStream() (*smux.Stream, error) {
+	c.mu.Lock()
+	sessions := append([]*smux.Session{}, c.sessions...)
+	start := c.nextSession
+	c.nextSession++
+	c.mu.Unlock()
+
+	var lastErr error = fmt.Errorf("client %s has no open session", c.ID)
+	for i := range sessions {
+		session := sessions[(start+i)%len(sessions)]
+		if session.IsClosed() {
+			continue
+		}
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// SetRunID records the run ID the client's primary session announced, so
+// further sessions of the same client can join it
+func (m *Manager) SetRunID(client *ClientInfo, runID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.runs[runID]; exists || client.RunID != "" {
+		return fmt.Errorf("run ID already in use")
+	}
+	client.RunID = runID
+	m.runs[runID] = client
+	return nil
+}
+
+// JoinClient adds the session of a newly connected client to the logical client
+// with runID. From then on memberID refers to that logical client.
+func (m *Manager) JoinClient(memberID, runID string) (*ClientInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	member, exists := m.clients[memberID]
+	if !exists || member.ID != memberID || member.RunID != "" {
+		return nil, fmt.Errorf("session %s cannot join another client", memberID)
+	}
+	member.mu.Lock()
+	hasProxies := len(member.Proxies) > 0
+	member.mu.Unlock()
+	if hasProxies {
+		return nil, fmt.Errorf("session %s already registered proxies", memberID)
+	}
+	client, exists := m.runs[runID]
+	if !exists {
+		return nil, fmt.Errorf("unknown run ID")
+	}
+
+	client.mu.Lock()
+	client.sessions = append(client.sessions, member.Session)
+	client.members[memberID] = member.Session
+	count := len(client.sessions)
+	client.mu.Unlock()
+
+	member.joined.Store(true)
+	m.clients[memberID] = client
+	log.Printf("Session %s joined client %s (%d sessions)", memberID, client.ID, count)
+	return client, nil
+}
+
+// leaveLocked detaches a joined session from its logical client
+func (m *Manager) leaveLocked(client *ClientInfo, memberID string) {
+	client.mu.Lock()
+	session := client.members[memberID]
+	delete(client.members, memberID)
+	for i, s := range client.sessions {
+		if s == session {
+			client.sessions = append(client.sessions[:i], client.sessions[i+1:]...)
+			break
+		}
+	}
+	count := len(client.sessions)
+	client.mu.Unlock()
+
+	delete(m.clients, memberID)
+	log.Printf("Session %s left client %s (%d sessions)", memberID, client.ID, count)
+}
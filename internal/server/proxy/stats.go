@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyStats holds traffic counters for a proxy
+type ProxyStats struct {
+	Conns     atomic.Uint64 // Connections (TCP) or peer sessions (UDP) accepted
+	Active    atomic.Int64  // Connections or peer sessions currently being forwarded
+	BytesIn   atomic.Uint64 // Bytes from public users to the client
+	BytesOut  atomic.Uint64 // Bytes from the client to public users
+	Denied    atomic.Uint64 // Connections/packets dropped by the ACL
+	Rejected  atomic.Uint64 // Connections/packets turned away by admission limits
+	Throttled atomic.Uint64 // Writes delayed, or UDP packets dropped, by a bandwidth limit
+
+	PoolHits      atomic.Uint64 // Connections served on a stream the client opened in advance
+	PoolMisses    atomic.Uint64 // Connections that found the stream pool empty
+	FirstByteTime atomic.Int64  // Total time from stream setup to the first byte back from the client
+	FirstBytes    atomic.Uint64 // Connections counted in FirstByteTime
+
+	// Bytes on the tunnel after compression, for proxies that compress
+	WireIn  atomic.Uint64
+	WireOut atomic.Uint64
+}
+
+// avgFirstByte is the mean time from stream setup to the first byte back from the client
+func (s *ProxyStats) avgFirstByte() time.Duration {
+	n := s.FirstBytes.Load()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(s.FirstByteTime.Load() / int64(n)).Round(time.Microsecond)
+}
+
+// compressionRatios returns how many times smaller traffic in each direction is on the tunnel
+func (s *ProxyStats) compressionRatios() string {
+	ratio := func(raw, wire uint64) string {
+		if wire == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.2f", float64(raw)/float64(wire))
+	}
+	return ratio(s.BytesIn.Load(), s.WireIn.Load()) + "/" + ratio(s.BytesOut.Load(), s.WireOut.Load())
+}
+
+// LogStats logs the counters of every registered proxy
+func (m *Manager) LogStats() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, client := range m.clients {
+		if client.ID != id {
+			continue // a joined session, logged with its client
+		}
+
+		client.mu.Lock()
+		for _, proxy := range client.Proxies {
+			limit := "unlimited"
+			if proxy.Limiter != nil {
+				limit = formatRate(int64(proxy.Limiter.Limit()))
+			}
+
+			log.Printf("Stats for proxy %s (client %s, port %d): conns=%d active=%d in=%d out=%d denied=%d rejected=%d throttled=%d limit=%s healthy=%t pool=%d/%d pool_hits=%d pool_misses=%d ttfb=%s",
+				proxy.Name, client.ID, proxy.RemotePort,
+				proxy.Stats.Conns.Load(), proxy.Stats.Active.Load(),
+				proxy.Stats.BytesIn.Load(), proxy.Stats.BytesOut.Load(),
+				proxy.Stats.Denied.Load(), proxy.Stats.Rejected.Load(),
+				proxy.Stats.Throttled.Load(), limit, proxy.Healthy(),
+				len(proxy.pool), cap(proxy.pool),
+				proxy.Stats.PoolHits.Load(), proxy.Stats.PoolMisses.Load(),
+				proxy.Stats.avgFirstByte())
+
+			if proxy.Compression != "" {
+				log.Printf("Compression for proxy %s (%s): in=%d->%d out=%d->%d ratio in/out=%s",
+					proxy.Name, proxy.Compression,
+					proxy.Stats.BytesIn.Load(), proxy.Stats.WireIn.Load(),
+					proxy.Stats.WireOut.Load(), proxy.Stats.BytesOut.Load(),
+					proxy.Stats.compressionRatios())
+			}
+		}
+		client.mu.Unlock()
+	}
+}
+
+func formatRate(bytesPerSec int64) string {
+	switch {
+	case bytesPerSec >= 1<<20:
+		return fmt.Sprintf("%.1fMiB/s", float64(bytesPerSec)/(1<<20))
+	case bytesPerSec >= 1<<10:
+		return fmt.Sprintf("%.1fKiB/s", float64(bytesPerSec)/(1<<10))
+	}
+	return fmt.Sprintf("%dB/s", bytesPerSec)
+}
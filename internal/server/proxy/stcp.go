@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// errVisitDenied hides whether a secret proxy exists from visitors with the wrong secret
+var errVisitDenied = errors.New("unknown proxy or invalid secret")
+
+// registerSecretLocked registers an STCP proxy, which is known only by name and has no public port
+func (m *Manager) registerSecretLocked(client *ClientInfo, proxy *ProxyInfo) error {
+	if proxy.Secret == "" {
+		return fmt.Errorf("secret proxy %s has no secret", proxy.Name)
+	}
+	if _, exists := m.secretProxies[proxy.Name]; exists {
+		return fmt.Errorf("secret proxy %s already registered", proxy.Name)
+	}
+
+	proxy.Client = client
+	m.secretProxies[proxy.Name] = proxy
+
+	client.mu.Lock()
+	client.Proxies[proxy.Name] = proxy
+	client.mu.Unlock()
+
+	log.Printf("Registered secret proxy %s", proxy.Name)
+	return nil
+}
+
+// Visit looks up the secret proxy a visitor asks for and checks its secret
+func (m *Manager) Visit(name, secret string) (*ProxyInfo, error) {
+	m.mu.Lock()
+	proxy := m.secretProxies[name]
+	m.mu.Unlock()
+
+	if proxy == nil || subtle.ConstantTimeCompare([]byte(proxy.Secret), []byte(secret)) != 1 {
+		return nil, errVisitDenied
+	}
+	if !proxy.Healthy() {
+		return nil, fmt.Errorf("secret proxy %s is unhealthy", name)
+	}
+	return proxy, nil
+}
+
+// ServeVisitor relays a visitor's stream to the client that owns a secret proxy
+func ServeVisitor(conn net.Conn, proxy *ProxyInfo) {
+	if !proxy.ACL.Allowed(conn.RemoteAddr()) {
+		denied := proxy.Stats.Denied.Add(1)
+		log.Printf("Dropped visitor for proxy %s from %s (not allowed, %d dropped)",
+			proxy.Name, conn.RemoteAddr(), denied)
+		conn.Close()
+		return
+	}
+
+	log.Printf("New visitor for proxy %s from %s", proxy.Name, conn.RemoteAddr())
+	handleProxyConnection(conn, proxy.Client, proxy)
+}
@@ -1,17 +1,24 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
 )
 
-// StartTCPListener starts a TCP listener for a proxy
-func StartTCPListener(proxy *ProxyInfo, client *ClientInfo) error {
+// tlsHandshakeTimeout bounds how long a public user may take to complete a TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// StartTCPListener starts the TCP listener shared by a proxy's group
+func StartTCPListener(proxy *ProxyInfo) error {
 	listenAddr := fmt.Sprintf(":%d", proxy.RemotePort)
 	log.Printf("Starting TCP listener for proxy %s on %s", proxy.Name, listenAddr)
 
@@ -30,23 +37,55 @@ func StartTCPListener(proxy *ProxyInfo, client *ClientInfo) error {
 	// Confirm the listener is actually working
 	log.Printf("TCP proxy %s successfully listening on port %s", proxy.Name, portStr)
 
-	proxy.Listener = listener
+	if proxy.TLSConfig != nil {
+		log.Printf("TCP proxy %s terminates TLS on port %s", proxy.Name, portStr)
+		listener = tls.NewListener(listener, proxy.TLSConfig)
+	}
+
+	group := proxy.group
+	group.mu.Lock()
+	group.Listener = listener
+	group.mu.Unlock()
 
 	// Start accepting connections
-	go acceptConnections(listener, client, proxy)
+	go acceptConnections(listener, group)
 
 	return nil
 }
 
-// acceptConnections accepts connections on a TCP listener
-func acceptConnections(listener net.Listener, client *ClientInfo, proxy *ProxyInfo) {
+// acceptConnections accepts connections on a TCP listener and hands each one to a group member
+func acceptConnections(listener net.Listener, group *ProxyGroup) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Listener for proxy %s closed: %v", proxy.Name, err)
+			log.Printf("Listener for %s closed: %v", group.label, err)
 			break
 		}
 
+		proxy := group.pick()
+		if proxy == nil {
+			log.Printf("No healthy proxy available in %s for %s", group.label, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		client := proxy.Client
+
+		if !proxy.ACL.Allowed(conn.RemoteAddr()) {
+			denied := proxy.Stats.Denied.Add(1)
+			log.Printf("Dropped connection for proxy %s from %s (not allowed, %d dropped)",
+				proxy.Name, conn.RemoteAddr(), denied)
+			conn.Close()
+			continue
+		}
+
+		if !client.admission.allowIP(conn.RemoteAddr()) {
+			rejected := proxy.Stats.Rejected.Add(1)
+			log.Printf("Rejected connection for proxy %s from %s (accept rate exceeded, %d rejected)",
+				proxy.Name, conn.RemoteAddr(), rejected)
+			conn.Close()
+			continue
+		}
+
 		log.Printf("New connection for proxy %s from %s", proxy.Name, conn.RemoteAddr())
 
 		go handleProxyConnection(conn, client, proxy)
@@ -57,14 +96,69 @@ func acceptConnections(listener net.Listener, client *ClientInfo, proxy *ProxyIn
 func handleProxyConnection(conn net.Conn, client *ClientInfo, proxy *ProxyInfo) {
 	defer conn.Close()
 
-	// Open a new stream to the client
-	stream, err := client.Session.OpenStream()
+	release, ok := client.admit(proxy)
+	if !ok {
+		log.Printf("Rejected connection for proxy %s from %s (connection limit reached, policy %s)",
+			proxy.Name, conn.RemoteAddr(), client.admission.cfg.Policy)
+		return
+	}
+	defer release()
+
+	// Finish the TLS handshake before involving the client so failed handshakes cost no stream
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake failed for proxy %s from %s: %v", proxy.Name, conn.RemoteAddr(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
+	setupStart := time.Now()
+
+	// Get a stream to the client, which will then connect to the local service
+	dataStream, err := openDataStream(client, proxy, conn.RemoteAddr())
 	if err != nil {
 		log.Printf("Failed to open stream to client: %v", err)
 		return
 	}
-	defer stream.Close()
+	defer dataStream.Close()
+
+	// Compression starts after the NewStream header
+	var stream net.Conn = dataStream
+	if proxy.Compression != "" {
+		wire := &countingConn{Conn: dataStream, read: &proxy.Stats.WireOut, written: &proxy.Stats.WireIn}
+		if stream, err = tunnel.Compress(wire, proxy.Compression); err != nil {
+			log.Printf("Failed to compress stream for proxy %s: %v", proxy.Name, err)
+			return
+		}
+		defer stream.Close()
+	}
+
+	// Now copy data in both directions:
+	//  This creates a complete bidirectional pipe between the incoming connection and
+	//  the client-side service, which is the essence of the tunneling functionality.
+
+	proxy.Stats.Conns.Add(1)
+	proxy.Stats.Active.Add(1)
+	defer proxy.Stats.Active.Add(-1)
+
+	bw := newBandwidth(client, proxy)
+
+	go func() {
+		// conn/server -> stream/client
+		_, _ = io.Copy(&meteredWriter{w: stream, bw: bw, counter: &proxy.Stats.BytesIn}, conn)
+		stream.Close()
+	}()
 
+	// stream/client -> conn/server
+	out := &firstByteWriter{w: conn, start: setupStart, stats: &proxy.Stats}
+	_, _ = io.Copy(&meteredWriter{w: out, bw: bw, counter: &proxy.Stats.BytesOut}, stream)
+}
+
+// writeNewStream tells the client which proxy a data stream is for, and who
+// the public peer is if the proxy asked for it
+func writeNewStream(stream *smux.Stream, proxy *ProxyInfo, peer net.Addr) error {
 	streamID := stream.ID()
 
 	// Format:
@@ -73,6 +167,7 @@ func handleProxyConnection(conn net.Conn, client *ClientInfo, proxy *ProxyInfo)
 	// 3. Remote port (2 bytes)
 	// 4. Name length (1 byte)
 	// 5. Proxy name (variable)
+	// 6. With PeerAddr: address length (1 byte) and host:port (variable)
 
 	nameBytes := []byte(proxy.Name)
 	nameLen := len(nameBytes)
@@ -85,28 +180,54 @@ func handleProxyConnection(conn net.Conn, client *ClientInfo, proxy *ProxyInfo)
 	if nameLen > 0 {
 		copy(msgBuf[8:], nameBytes)
 	}
+	if proxy.PeerAddr {
+		addr := peer.String()
+		msgBuf = append(msgBuf, byte(len(addr)))
+		msgBuf = append(msgBuf, addr...)
+	}
 
 	log.Printf("Sending NewStream for proxy %s (port %d), stream ID: %d",
 		proxy.Name, proxy.RemotePort, streamID)
 
 	// Send the complete message in one write
-	// The message is sent to the client, which will then connect to the local service.
-	_, err = stream.Write(msgBuf)
-	if err != nil {
-		log.Printf("Failed to send NewStream message: %v", err)
-		return
+	if _, err := stream.Write(msgBuf); err != nil {
+		return fmt.Errorf("failed to send NewStream message: %w", err)
 	}
+	return nil
+}
 
-	// Now copy data in both directions:
-	//  This creates a complete bidirectional pipe between the incoming connection and
-	//  the client-side service, which is the essence of the tunneling functionality.
+// countingConn counts the bytes that cross the tunnel after compression
+type countingConn struct {
+	net.Conn
+	read    *atomic.Uint64
+	written *atomic.Uint64
+}
 
-	go func() {
-		// conn/server -> stream/client
-		_, _ = io.Copy(stream, conn)
-		stream.Close()
-	}()
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(uint64(n))
+	return n, err
+}
 
-	// stream/client -> conn/server
-	_, _ = io.Copy(conn, stream)
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// firstByteWriter records how long the first response byte took after stream setup began
+type firstByteWriter struct {
+	w     io.Writer
+	start time.Time
+	stats *ProxyStats
+	seen  bool
+}
+
+func (f *firstByteWriter) Write(p []byte) (int, error) {
+	if !f.seen && len(p) > 0 {
+		f.seen = true
+		f.stats.FirstByteTime.Add(int64(time.Since(f.start)))
+		f.stats.FirstBytes.Add(1)
+	}
+	return f.w.Write(p)
 }
@@ -5,91 +5,320 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/markCwatson/mgrok/internal/tunnel"
+	"github.com/xtaci/smux"
 )
 
-// StartUDPListener starts a UDP listener for a proxy
-func StartUDPListener(proxy *ProxyInfo, client *ClientInfo) error {
+const (
+	defaultUDPSessionTimeout = 60 * time.Second
+	defaultMaxUDPSessions    = 1024
+
+	// udpSessionQueue is how many datagrams from one peer may wait for its
+	// stream; more are dropped while a bandwidth limit holds the peer back
+	udpSessionQueue = 64
+)
+
+// UDPSessionConfig controls the per-peer session table of a UDP proxy
+type UDPSessionConfig struct {
+	Timeout     time.Duration // Idle time after which a peer's stream is closed
+	MaxSessions int           // Maximum concurrent peers per proxy
+}
+
+// udpSession is the stream carrying all datagrams of one remote peer
+type udpSession struct {
+	addr       *net.UDPAddr
+	proxy      *ProxyInfo // Group member chosen for this peer
+	stream     *smux.Stream
+	bw         *bandwidth
+	release    func()
+	lastActive atomic.Int64 // unix nanoseconds
+
+	packets chan []byte   // Length-prefixed datagrams waiting for the session's writer
+	done    chan struct{} // Closed when the session is removed
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// udpSessionTable maps remote peer addresses to their sessions
+type udpSessionTable struct {
+	cfg      UDPSessionConfig
+	sessions map[string]*udpSession
+	mu       sync.Mutex
+}
+
+// StartUDPListener starts the UDP listener shared by a proxy's group
+func StartUDPListener(proxy *ProxyInfo, cfg UDPSessionConfig) error {
 	addr := net.UDPAddr{Port: int(proxy.RemotePort)}
 	conn, err := net.ListenUDP("udp", &addr)
 	if err != nil {
 		return err
 	}
-	proxy.UDPConn = conn
-	go acceptUDPPackets(conn, client, proxy)
+
+	group := proxy.group
+	group.mu.Lock()
+	group.UDPConn = conn
+	group.mu.Unlock()
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultUDPSessionTimeout
+	}
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = defaultMaxUDPSessions
+	}
+	table := &udpSessionTable{cfg: cfg, sessions: make(map[string]*udpSession)}
+
+	go acceptUDPPackets(conn, group, table)
 	log.Printf("UDP proxy %s listening on %d", proxy.Name, proxy.RemotePort)
 	return nil
 }
 
-func acceptUDPPackets(conn *net.UDPConn, client *ClientInfo, proxy *ProxyInfo) {
-	buf := make([]byte, 65535)
+func acceptUDPPackets(conn *net.UDPConn, group *ProxyGroup, table *udpSessionTable) {
+	done := make(chan struct{})
+	defer close(done)
+	defer table.closeAll()
+	go table.reap(done)
+
+	// datagrams are read after a 2 byte length prefix so each one goes out in a single write
+	frame := make([]byte, 2+65535)
 	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		n, remoteAddr, err := conn.ReadFromUDP(frame[2:])
 		if err != nil {
-			log.Printf("UDP listener for proxy %s closed: %v", proxy.Name, err)
+			log.Printf("UDP listener for %s closed: %v", group.label, err)
 			return
 		}
-		data := make([]byte, n)
-		copy(data, buf[:n])
-		go handleUDPPacket(conn, remoteAddr, data, client, proxy)
+
+		// Existing peers stay with the member chosen for them; new peers are load balanced
+		var proxy *ProxyInfo
+		sess := table.get(remoteAddr)
+		if sess != nil {
+			proxy = sess.proxy
+		} else {
+			proxy = group.pick()
+		}
+		if proxy == nil {
+			log.Printf("No healthy proxy available in %s for %s", group.label, remoteAddr)
+			continue
+		}
+
+		if !proxy.ACL.Allowed(remoteAddr) {
+			denied := proxy.Stats.Denied.Add(1)
+			log.Printf("Dropped UDP packet for proxy %s from %s (not allowed, %d dropped)",
+				proxy.Name, remoteAddr, denied)
+			continue
+		}
+
+		if sess == nil {
+			sess = openUDPSession(conn, remoteAddr, proxy, table)
+			if sess == nil {
+				continue
+			}
+		}
+		sess.touch()
+
+		// forward udp msg to client, length prefixed to keep datagram boundaries.
+		// The session's own writer applies the bandwidth limit, so a throttled
+		// peer never holds up the others.
+		binary.BigEndian.PutUint16(frame[:2], uint16(n))
+		select {
+		case sess.packets <- append([]byte(nil), frame[:2+n]...):
+		default:
+			proxy.Stats.Throttled.Add(1)
+		}
 	}
 }
 
-func handleUDPPacket(conn *net.UDPConn, addr *net.UDPAddr, data []byte, client *ClientInfo, proxy *ProxyInfo) {
-	stream, err := client.Session.OpenStream()
-	if err != nil {
-		log.Printf("Failed to open UDP stream: %v", err)
-		return
+// openUDPSession opens the stream for a new remote peer and starts forwarding its responses
+func openUDPSession(conn *net.UDPConn, addr *net.UDPAddr, proxy *ProxyInfo, table *udpSessionTable) *udpSession {
+	client := proxy.Client
+
+	if table.full() {
+		rejected := proxy.Stats.Rejected.Add(1)
+		log.Printf("Dropped UDP packet for proxy %s from %s (session table full, %d rejected)",
+			proxy.Name, addr, rejected)
+		return nil
 	}
-	defer stream.Close()
 
-	streamID := stream.ID()
-	nameBytes := []byte(proxy.Name)
-	nameLen := len(nameBytes)
-	msgBuf := make([]byte, 8+nameLen)
+	if !client.admission.allowIP(addr) {
+		rejected := proxy.Stats.Rejected.Add(1)
+		log.Printf("Dropped UDP packet for proxy %s from %s (accept rate exceeded, %d rejected)",
+			proxy.Name, addr, rejected)
+		return nil
+	}
+
+	// Queueing here would stall every other peer of this proxy, so never wait
+	release, ok := client.tryAdmit(proxy)
+	if !ok {
+		log.Printf("Dropped UDP packet for proxy %s from %s (connection limit reached)", proxy.Name, addr)
+		return nil
+	}
 
-	// Message format: [MsgType][StreamID][RemotePort][NameLen][ProxyName]
-	msgBuf[0] = tunnel.MsgTypeNewStream
-	binary.BigEndian.PutUint32(msgBuf[1:5], streamID)
-	binary.BigEndian.PutUint16(msgBuf[5:7], proxy.RemotePort)
-	msgBuf[7] = byte(nameLen)
-	if nameLen > 0 {
-		copy(msgBuf[8:], nameBytes)
+	stream, err := client.OpenStream()
+	if err != nil {
+		log.Printf("Failed to open UDP stream: %v", err)
+		release()
+		return nil
 	}
-	if _, err := stream.Write(msgBuf); err != nil {
+
+	if err := writeNewStream(stream, proxy, addr); err != nil {
 		log.Printf("Failed to write NewStream: %v", err)
-		return
+		stream.Close()
+		release()
+		return nil
 	}
 
-	// forward udp msg to client
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(data)))
-	if _, err := stream.Write(length); err != nil {
-		return
+	sess := &udpSession{
+		addr:    addr,
+		proxy:   proxy,
+		stream:  stream,
+		bw:      newBandwidth(client, proxy),
+		release: release,
+		packets: make(chan []byte, udpSessionQueue),
+		done:    make(chan struct{}),
 	}
-	if _, err := stream.Write(data); err != nil {
-		return
+	sess.touch()
+	table.add(sess)
+
+	proxy.Stats.Conns.Add(1)
+	proxy.Stats.Active.Add(1)
+	log.Printf("New UDP session for proxy %s from %s, stream ID: %d", proxy.Name, addr, stream.ID())
+
+	go forwardUDPPackets(sess, table)
+	go handleUDPSession(conn, sess, table)
+	return sess
+}
+
+// forwardUDPPackets writes the peer's datagrams to its stream, waiting for the bandwidth limits
+func forwardUDPPackets(sess *udpSession, table *udpSessionTable) {
+	for {
+		var packet []byte
+		select {
+		case packet = <-sess.packets:
+		case <-sess.done:
+			return
+		}
+
+		n := len(packet) - 2
+		sess.bw.wait(n)
+		if _, err := sess.stream.Write(packet); err != nil {
+			log.Printf("Failed to forward UDP packet from %s: %v", sess.addr, err)
+			table.remove(sess)
+			return
+		}
+		sess.proxy.Stats.BytesIn.Add(uint64(n))
 	}
+}
 
-	// bidirectional forwarding loop (read from client and forward to external udp port)
+// handleUDPSession reads responses from the client and forwards them to the remote peer
+func handleUDPSession(conn *net.UDPConn, sess *udpSession, table *udpSessionTable) {
+	defer table.remove(sess)
+
+	lenBuf := make([]byte, 2)
+	buf := make([]byte, 65535)
 	for {
-		lenBuf := make([]byte, 2)
-		if _, err := io.ReadFull(stream, lenBuf); err != nil {
+		if _, err := io.ReadFull(sess.stream, lenBuf); err != nil {
 			if err != io.EOF {
 				log.Printf("UDP stream read error: %v", err)
 			}
 			return
 		}
 		l := binary.BigEndian.Uint16(lenBuf)
-		buf := make([]byte, l)
-		if _, err := io.ReadFull(stream, buf); err != nil {
+		if _, err := io.ReadFull(sess.stream, buf[:l]); err != nil {
 			log.Printf("UDP stream read error: %v", err)
 			return
 		}
-		if _, err := conn.WriteToUDP(buf, addr); err != nil {
+
+		sess.touch()
+		sess.bw.wait(int(l))
+		if _, err := conn.WriteToUDP(buf[:l], sess.addr); err != nil {
 			log.Printf("Failed to write UDP response: %v", err)
 			return
 		}
+		sess.proxy.Stats.BytesOut.Add(uint64(l))
+	}
+}
+
+func (t *udpSessionTable) get(addr *net.UDPAddr) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.sessions[addr.String()]
+}
+
+func (t *udpSessionTable) full() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.sessions) >= t.cfg.MaxSessions
+}
+
+func (t *udpSessionTable) add(sess *udpSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sessions[sess.addr.String()] = sess
+}
+
+// remove closes a session; safe to call more than once
+func (t *udpSessionTable) remove(sess *udpSession) {
+	t.mu.Lock()
+	current, exists := t.sessions[sess.addr.String()]
+	if !exists || current != sess {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.sessions, sess.addr.String())
+	t.mu.Unlock()
+
+	close(sess.done)
+	sess.stream.Close()
+	sess.release()
+	sess.proxy.Stats.Active.Add(-1)
+}
+
+// reap closes sessions that have been idle longer than the timeout
+func (t *udpSessionTable) reap(done <-chan struct{}) {
+	ticker := time.NewTicker(t.cfg.Timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(-t.cfg.Timeout).UnixNano()
+		var idle []*udpSession
+
+		t.mu.Lock()
+		for _, sess := range t.sessions {
+			if sess.lastActive.Load() < deadline {
+				idle = append(idle, sess)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, sess := range idle {
+			log.Printf("Closing idle UDP session for proxy %s from %s", sess.proxy.Name, sess.addr)
+			t.remove(sess)
+		}
+	}
+}
+
+func (t *udpSessionTable) closeAll() {
+	t.mu.Lock()
+	sessions := make([]*udpSession, 0, len(t.sessions))
+	for _, sess := range t.sessions {
+		sessions = append(sessions, sess)
+	}
+	t.mu.Unlock()
+
+	for _, sess := range sessions {
+		t.remove(sess)
 	}
 }
@@ -2,23 +2,31 @@ package tls
 
 import (
 	"crypto/tls"
+	"fmt"
 	"log"
-	"net"
+	"sync"
 
 	"github.com/markCwatson/mgrok/internal/config"
 )
 
 type Manager struct {
-	TLSCertFile string
-	TLSKeyFile  string
-	EnableTLS   bool
+	TLSCertFile  string
+	TLSKeyFile   string
+	EnableTLS    bool
+	Certificates map[string]config.CertConfig
+
+	// certificates already loaded for TLS termination, by name
+	loaded map[string]*tls.Certificate
+	mu     sync.Mutex
 }
 
 func NewManager(config *config.ServerConfig) *Manager {
 	return &Manager{
-		TLSCertFile: config.TLSCertFile,
-		TLSKeyFile:  config.TLSKeyFile,
-		EnableTLS:   config.EnableTLS,
+		TLSCertFile:  config.TLSCertFile,
+		TLSKeyFile:   config.TLSKeyFile,
+		EnableTLS:    config.EnableTLS,
+		Certificates: config.Certificates,
+		loaded:       make(map[string]*tls.Certificate),
 	}
 }
 
@@ -31,13 +39,42 @@ func (m *Manager) GetTLSConfig() *tls.Config {
 	return &tls.Config{Certificates: []tls.Certificate{cert}}
 }
 
-// will fallback to plain TCP if TLS certificate and key files are not set
-func (m *Manager) Listen(addr string) (net.Listener, error) {
-	if m.EnableTLS {
-		log.Printf("Listening on %s with TLS", addr)
-		return tls.Listen("tcp", addr, m.GetTLSConfig())
+// TerminationConfig returns the TLS config a proxy uses to terminate TLS on its
+// public port. An empty name selects the server's own certificate.
+func (m *Manager) TerminationConfig(name string) (*tls.Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cert, exists := m.loaded[name]
+	if !exists {
+		certFile, keyFile := m.TLSCertFile, m.TLSKeyFile
+		if name != "" {
+			certCfg, ok := m.Certificates[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown certificate %q", name)
+			}
+			certFile, keyFile = certCfg.CertFile, certCfg.KeyFile
+		}
+
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("no certificate configured for TLS termination")
+		}
+
+		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate %q: %w", name, err)
+		}
+		cert = &loaded
+		m.loaded[name] = cert
 	}
 
-	log.Printf("Listening on %s without TLS", addr)
-	return net.Listen("tcp", addr)
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}, nil
+}
+
+// ListenerConfig returns the TLS config for tunnel listeners, or nil when TLS is disabled
+func (m *Manager) ListenerConfig() *tls.Config {
+	if !m.EnableTLS {
+		return nil
+	}
+	return m.GetTLSConfig()
 }
@@ -0,0 +1,380 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// noisePrologue binds the handshake to this protocol; both sides must use the same one
+	noisePrologue = "mgrok-noise"
+
+	// noiseHandshakeTimeout bounds the Noise handshake on both sides
+	noiseHandshakeTimeout = 10 * time.Second
+
+	// noiseMaxPlaintext is the most data sealed in one transport message
+	noiseMaxPlaintext = noise.MaxMsgLen - 16
+)
+
+// ErrNoiseAuth means a message did not decrypt or the peer's key was not accepted
+var ErrNoiseAuth = errors.New("noise authentication failed")
+
+var noiseSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+func init() {
+	Register("noise", func(opts Options) (Transport, error) {
+		cfg := opts.Noise
+		if cfg == nil {
+			cfg = &NoiseConfig{}
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+		return &noiseTransport{opts: opts, cfg: cfg}, nil
+	})
+}
+
+// NoiseConfig holds the static keys for the noise transport. Keys are base64
+// encoded Curve25519 keys, as printed by the server's -gen-noise-key flag.
+type NoiseConfig struct {
+	PrivateKey string   `yaml:"private_key"` // Required on the server; the client uses a random key when unset
+	ServerKey  string   `yaml:"server_key"`  // Client: the server's public key to pin
+	ClientKeys []string `yaml:"client_keys"` // Server: only accept clients with these public keys (empty accepts any)
+}
+
+// Validate checks that every configured key decodes to a Curve25519 key
+func (c *NoiseConfig) Validate() error {
+	if c.PrivateKey != "" {
+		if _, err := decodeNoiseKey(c.PrivateKey); err != nil {
+			return fmt.Errorf("noise private_key: %w", err)
+		}
+	}
+	if c.ServerKey != "" {
+		if _, err := decodeNoiseKey(c.ServerKey); err != nil {
+			return fmt.Errorf("noise server_key: %w", err)
+		}
+	}
+	for i, key := range c.ClientKeys {
+		if _, err := decodeNoiseKey(key); err != nil {
+			return fmt.Errorf("noise client_keys[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// keypair returns the static keypair, or a random one when no private key is set
+func (c *NoiseConfig) keypair() (noise.DHKey, error) {
+	if c.PrivateKey == "" {
+		return noiseSuite.GenerateKeypair(rand.Reader)
+	}
+
+	private, err := decodeNoiseKey(c.PrivateKey)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{Private: private, Public: public}, nil
+}
+
+// allowed reports whether a client's static public key may connect
+func (c *NoiseConfig) allowed(peer []byte) bool {
+	if len(c.ClientKeys) == 0 {
+		return true
+	}
+	for _, key := range c.ClientKeys {
+		if k, err := decodeNoiseKey(key); err == nil && subtle.ConstantTimeCompare(k, peer) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeNoiseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// GenerateNoiseKey returns a new base64 encoded private key and its public key
+func GenerateNoiseKey() (string, string, error) {
+	kp, err := noiseSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(kp.Private), base64.StdEncoding.EncodeToString(kp.Public), nil
+}
+
+// NoisePublicKey returns the public key that belongs to a base64 encoded private key
+func NoisePublicKey(privateKey string) (string, error) {
+	kp, err := (&NoiseConfig{PrivateKey: privateKey}).keypair()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(kp.Public), nil
+}
+
+// noiseTransport runs the tunnel over TCP encrypted with a Noise IK handshake.
+// The client pins the server's static public key, so no certificates are needed.
+type noiseTransport struct {
+	opts Options
+	cfg  *NoiseConfig
+}
+
+func (t *noiseTransport) Dial(ctx context.Context) (net.Conn, error) {
+	if t.cfg.ServerKey == "" {
+		return nil, fmt.Errorf("the noise transport needs the server's public key (noise.server_key)")
+	}
+	serverKey, _ := decodeNoiseKey(t.cfg.ServerKey)
+	static, err := t.cfg.keypair()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connecting to server at %s using Noise", t.opts.Addr)
+	conn, err := t.opts.dial()(ctx, "tcp", t.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &noiseConn{Conn: conn}
+	if err := nc.clientHandshake(static, serverKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return nc, nil
+}
+
+func (t *noiseTransport) Listen() (net.Listener, error) {
+	if t.cfg.PrivateKey == "" {
+		return nil, fmt.Errorf("the noise transport needs a server private key (noise.private_key)")
+	}
+	static, err := t.cfg.keypair()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := t.opts.Socket.listen(t.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseListener{Listener: base, static: static, cfg: t.cfg}, nil
+}
+
+// noiseListener runs the responder side of the handshake on every accepted connection
+type noiseListener struct {
+	net.Listener
+	static noise.DHKey
+	cfg    *NoiseConfig
+}
+
+func (l *noiseListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// The handshake runs on first use so a slow client does not hold up Accept
+	nc := &noiseConn{Conn: conn}
+	nc.handshakeFn = func() error { return nc.serverHandshake(l.static, l.cfg) }
+	return nc, nil
+}
+
+// noiseConn encrypts a connection with the cipher states from a Noise handshake.
+// Every message is uint16 length | message, for the handshake and for data.
+type noiseConn struct {
+	net.Conn
+
+	handshakeFn   func() error // Server: runs the handshake on first Read or Write
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	recv    *noise.CipherState
+	readBuf []byte // Decrypted data not returned yet
+	rmu     sync.Mutex
+
+	send *noise.CipherState
+	wmu  sync.Mutex
+}
+
+// clientHandshake runs the IK initiator side: -> e, es, s, ss and <- e, ee, se
+func (c *noiseConn) clientHandshake(static noise.DHKey, serverKey []byte) error {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     true,
+		Prologue:      []byte(noisePrologue),
+		StaticKeypair: static,
+		PeerStatic:    serverKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(noiseHandshakeTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	msg, _, _, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.writeMessage(msg); err != nil {
+		return fmt.Errorf("failed to send noise handshake: %w", err)
+	}
+
+	msg, err = c.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read noise handshake: %w", err)
+	}
+	_, send, recv, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return fmt.Errorf("%w: server key does not match noise.server_key", ErrNoiseAuth)
+	}
+	c.send, c.recv = send, recv
+	return nil
+}
+
+// serverHandshake runs the IK responder side and checks the client's static key
+func (c *noiseConn) serverHandshake(static noise.DHKey, cfg *NoiseConfig) error {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     false,
+		Prologue:      []byte(noisePrologue),
+		StaticKeypair: static,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Conn.SetDeadline(time.Now().Add(noiseHandshakeTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	msg, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read noise handshake: %w", err)
+	}
+	if _, _, _, err := hs.ReadMessage(nil, msg); err != nil {
+		return fmt.Errorf("%w: client did not use this server's key", ErrNoiseAuth)
+	}
+	if !cfg.allowed(hs.PeerStatic()) {
+		return fmt.Errorf("%w: client key %s is not in noise.client_keys",
+			ErrNoiseAuth, base64.StdEncoding.EncodeToString(hs.PeerStatic()))
+	}
+
+	msg, recv, send, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := c.writeMessage(msg); err != nil {
+		return fmt.Errorf("failed to send noise handshake: %w", err)
+	}
+	c.send, c.recv = send, recv
+	return nil
+}
+
+// handshake runs the server handshake once; the client has finished it in Dial
+func (c *noiseConn) handshake() error {
+	if c.handshakeFn == nil {
+		return nil
+	}
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.handshakeFn()
+		if c.handshakeErr != nil {
+			log.Printf("Noise handshake with %s failed: %v", c.RemoteAddr(), c.handshakeErr)
+			c.Conn.Close()
+		}
+	})
+	return c.handshakeErr
+}
+
+func (c *noiseConn) readMessage() ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(c.Conn, lenBuf); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(c.Conn, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (c *noiseConn) writeMessage(msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := c.Conn.Write(append(frame, msg...))
+	return err
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if c.readBuf, err = c.recv.Decrypt(msg[:0], nil, msg); err != nil {
+			return 0, ErrNoiseAuth
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), noiseMaxPlaintext)]
+		frame := make([]byte, 2, 2+len(chunk)+16)
+		frame, err := c.send.Encrypt(frame, nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
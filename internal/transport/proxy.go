@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc opens a connection, directly or through an outbound proxy
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ProxyFromEnvironment returns the outbound proxy for reaching addr from
+// HTTPS_PROXY, or ALL_PROXY if that is unset, honoring NO_PROXY. It returns nil
+// when addr should be dialed directly.
+func ProxyFromEnvironment(addr string) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	if cfg.HTTPSProxy == "" {
+		cfg.HTTPSProxy = os.Getenv("ALL_PROXY")
+		if cfg.HTTPSProxy == "" {
+			cfg.HTTPSProxy = os.Getenv("all_proxy")
+		}
+	}
+
+	return cfg.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+}
+
+// ProxyDialer returns a DialFunc that connects through proxyURL, which may be
+// http://, https:// (HTTP CONNECT, optionally with basic auth) or socks5://.
+// The proxy itself is reached with direct; a nil proxyURL only uses direct.
+func ProxyDialer(proxyURL *url.URL, direct DialFunc) (DialFunc, error) {
+	if proxyURL == nil {
+		return direct, nil
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialConnect(ctx, direct, proxyURL, addr)
+		}, nil
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+
+		dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, contextDialer(direct))
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialConnect opens a tunnel to addr through an HTTP proxy with the CONNECT method
+func dialConnect(ctx context.Context, direct DialFunc, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	conn, err := direct(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy %s: %w", proxyAddr, err)
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", proxyAddr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", proxyAddr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddr, addr, resp.Status)
+	}
+
+	// The server may already have sent bytes after the response headers
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// contextDialer lets x/net/proxy dial through a DialFunc
+type contextDialer DialFunc
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// bufferedConn reads what the bufio.Reader already holds before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
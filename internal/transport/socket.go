@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SocketConfig tunes the TCP sockets under the tcp and websocket transports
+type SocketConfig struct {
+	KeepAlive int   `yaml:"tcp_keepalive"` // Seconds between TCP keepalive probes (0 uses Go's default of 15, -1 disables)
+	NoDelay   *bool `yaml:"tcp_nodelay"`   // Default true; false enables Nagle's algorithm
+}
+
+func (s SocketConfig) keepAlive() time.Duration {
+	if s.KeepAlive < 0 {
+		return -1
+	}
+	return time.Duration(s.KeepAlive) * time.Second
+}
+
+// tune applies the settings Dialer and ListenConfig cannot set themselves
+func (s SocketConfig) tune(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && s.NoDelay != nil {
+		tcpConn.SetNoDelay(*s.NoDelay)
+	}
+}
+
+// Dialer returns a DialFunc that connects directly with these socket settings
+func (s SocketConfig) Dialer() DialFunc {
+	dialer := &net.Dialer{KeepAlive: s.keepAlive()}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.tune(conn)
+		return conn, nil
+	}
+}
+
+// listen opens a TCP listener whose accepted connections use these socket settings
+func (s SocketConfig) listen(addr string) (net.Listener, error) {
+	lc := &net.ListenConfig{KeepAlive: s.keepAlive()}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tunedListener{Listener: listener, socket: s}, nil
+}
+
+// tunedListener applies socket settings to every accepted connection
+type tunedListener struct {
+	net.Listener
+	socket SocketConfig
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.socket.tune(conn)
+	return conn, nil
+}
@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+)
+
+func init() {
+	Register("tcp", func(opts Options) (Transport, error) {
+		return &tcpTransport{opts: opts}, nil
+	})
+}
+
+// tcpTransport runs the tunnel over a TCP connection, with TLS when available
+type tcpTransport struct {
+	opts Options
+}
+
+func (t *tcpTransport) Dial(ctx context.Context) (net.Conn, error) {
+	dial := t.opts.dial()
+
+	if t.opts.TLS != nil {
+		log.Printf("Connecting to server at %s using TLS", t.opts.Addr)
+		conn, err := dial(ctx, "tcp", t.opts.Addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, t.opts.TLS)
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			return tlsConn, nil
+		}
+		conn.Close()
+		log.Printf("Failed to connect to server using TLS. Will try plain TCP.")
+	}
+
+	conn, err := dial(ctx, "tcp", t.opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect using plain TCP: %w", err)
+	}
+	return conn, nil
+}
+
+func (t *tcpTransport) Listen() (net.Listener, error) {
+	listener, err := t.opts.Socket.listen(t.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return listenTLS(listener, t.opts.TLS), nil
+}
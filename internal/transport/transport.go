@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Transport carries tunnel connections of one kind, such as raw TCP or WebSocket.
+// The smux session and the control protocol run unchanged on top of the net.Conn.
+type Transport interface {
+	// Dial connects a client to the server
+	Dial(ctx context.Context) (net.Conn, error)
+	// Listen accepts client connections on the server
+	Listen() (net.Listener, error)
+}
+
+// Options configure a transport; each transport uses the fields that apply to it
+type Options struct {
+	Addr string // host:port to dial, or [host]:port to listen on
+
+	// Client: TLS to try first, falling back to an unencrypted connection.
+	// Server: TLS to accept connections with; nil listens without TLS.
+	TLS *tls.Config
+
+	Dial          DialFunc // Client: opens the underlying connection, e.g. through a proxy (default direct)
+	Socket        SocketConfig
+	WebSocketPath string
+	KCP           *KCPConfig
+	Noise         *NoiseConfig
+}
+
+func (o Options) dial() DialFunc {
+	if o.Dial != nil {
+		return o.Dial
+	}
+	return o.Socket.Dialer()
+}
+
+// Factory creates a transport from options
+type Factory func(opts Options) (Transport, error)
+
+var (
+	registry   = make(map[string]Factory)
+	registryMu sync.RWMutex
+)
+
+// Register makes a transport available by name in client and server configs
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("transport %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Registered reports whether a transport with this name exists
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, exists := registry[name]
+	return exists
+}
+
+// Names lists the registered transports
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the named transport; an empty name selects "tcp"
+func New(name string, opts Options) (Transport, error) {
+	if name == "" {
+		name = "tcp"
+	}
+
+	registryMu.RLock()
+	factory, exists := registry[name]
+	registryMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown transport %q (available: %v)", name, Names())
+	}
+	return factory(opts)
+}
+
+// listenTLS wraps listener in TLS when cfg is set
+func listenTLS(listener net.Listener, cfg *tls.Config) net.Listener {
+	if cfg == nil {
+		return listener
+	}
+	return tls.NewListener(listener, cfg)
+}
@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultWebSocketPath is where the server accepts WebSocket upgrades
+	DefaultWebSocketPath = "/mgrok"
+
+	// webSocketHandshakeTimeout bounds the HTTP upgrade on both sides
+	webSocketHandshakeTimeout = 10 * time.Second
+)
+
+func init() {
+	Register("websocket", func(opts Options) (Transport, error) {
+		return &webSocketTransport{opts: opts}, nil
+	})
+}
+
+// webSocketTransport runs the tunnel over a WebSocket, for networks that only allow HTTP(S)
+type webSocketTransport struct {
+	opts Options
+}
+
+func (t *webSocketTransport) Dial(ctx context.Context) (net.Conn, error) {
+	if t.opts.TLS != nil {
+		log.Printf("Connecting to server at %s over WebSocket using TLS", t.opts.Addr)
+		conn, err := DialWebSocket(ctx, t.opts.dial(), t.opts.Addr, t.opts.WebSocketPath, t.opts.TLS)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("Failed to connect to server using wss (%v). Will try plain ws.", err)
+	}
+	return DialWebSocket(ctx, t.opts.dial(), t.opts.Addr, t.opts.WebSocketPath, nil)
+}
+
+func (t *webSocketTransport) Listen() (net.Listener, error) {
+	base, err := t.opts.Socket.listen(t.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return ListenWebSocket(listenTLS(base, t.opts.TLS), t.opts.WebSocketPath), nil
+}
+
+// wsConn runs a byte stream over binary WebSocket messages so smux can use it as a net.Conn
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // Current message being read
+	rmu    sync.Mutex
+	wmu    sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		if c.reader == nil {
+			msgType, r, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if msgType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.wmu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wmu.Unlock()
+
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// DialWebSocket upgrades an HTTP(S) connection to addr at path and returns it as
+// a net.Conn. tlsConfig nil means plain ws://. The connection is opened with dial,
+// which may go through an outbound proxy.
+func DialWebSocket(ctx context.Context, dial DialFunc, addr, path string, tlsConfig *tls.Config) (net.Conn, error) {
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+
+	scheme := "ws"
+	if tlsConfig != nil {
+		scheme = "wss"
+	}
+
+	dialer := &websocket.Dialer{
+		NetDialContext:   dial,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: webSocketHandshakeTimeout,
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, addr, path)
+	ws, resp, err := dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("websocket upgrade to %s failed: %s", url, resp.Status)
+		}
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+// WebSocketListener accepts tunnel connections as WebSocket upgrades on an HTTP(S) listener
+type WebSocketListener struct {
+	base   net.Listener
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// ListenWebSocket serves HTTP on base, which may already be a TLS listener, and
+// hands out every successful upgrade on path as a new connection
+func ListenWebSocket(base net.Listener, path string) *WebSocketListener {
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+
+	l := &WebSocketListener{
+		base:  base,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	upgrader := &websocket.Upgrader{
+		HandshakeTimeout: webSocketHandshakeTimeout,
+		// Tunnel clients are not browsers, so there is no origin to check
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+
+		select {
+		case l.conns <- newWSConn(ws):
+		case <-l.done:
+			ws.Close()
+		}
+	})
+
+	l.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: webSocketHandshakeTimeout,
+	}
+	go l.server.Serve(base)
+
+	return l
+}
+
+func (l *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *WebSocketListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.server.Close()
+}
+
+func (l *WebSocketListener) Addr() net.Addr {
+	return l.base.Addr()
+}
@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compression algorithms a proxy may ask for at registration (OptCompress)
+const (
+	CompressionDeflate = "deflate"
+)
+
+// ValidCompression reports whether both ends can use the compression algorithm; empty means none
+func ValidCompression(algorithm string) bool {
+	return algorithm == "" || algorithm == CompressionDeflate
+}
+
+// CompressedConn compresses a data stream after the NewStream header. Every
+// write is flushed so interactive protocols are not held back by the compressor.
+type CompressedConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// Compress wraps conn with the named algorithm; an empty name returns conn unchanged
+func Compress(conn net.Conn, algorithm string) (net.Conn, error) {
+	switch algorithm {
+	case "":
+		return conn, nil
+	case CompressionDeflate:
+		w, err := flate.NewWriter(conn, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &CompressedConn{Conn: conn, r: flate.NewReader(conn), w: w}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", algorithm)
+}
+
+func (c *CompressedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *CompressedConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// Close ends the compressed stream so the peer reads a clean EOF, then closes the connection
+func (c *CompressedConn) Close() error {
+	c.wmu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.w.Close()
+	}
+	c.wmu.Unlock()
+
+	return c.Conn.Close()
+}
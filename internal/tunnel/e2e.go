@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// e2eKeySalt is mixed into the shared secret; both ends must use the same one
+	e2eKeySalt = "mgrok-e2e"
+
+	// e2eSaltSize is the random value each end sends first, so every stream gets fresh keys
+	e2eSaltSize = 32
+
+	// e2eMaxPlaintext is the most data sealed in one frame
+	e2eMaxPlaintext = 16 * 1024
+)
+
+// ErrE2EAuth means a frame did not decrypt, usually because the ends have different keys
+var ErrE2EAuth = errors.New("end-to-end decryption failed (wrong e2e_key?)")
+
+// E2EKey is a secret shared by the two clients at the ends of a data stream
+type E2EKey struct {
+	master []byte
+}
+
+// NewE2EKey derives the key material from a shared secret
+func NewE2EKey(secret string) *E2EKey {
+	return &E2EKey{master: pbkdf2.Key([]byte(secret), []byte(e2eKeySalt), 4096, 32, sha256.New)}
+}
+
+// SealedConn encrypts a data stream end to end, so the server relaying it sees
+// only ciphertext. Both ends first send a random salt; each direction is then
+// sealed with ChaCha20-Poly1305 under a key derived from both salts, with a
+// counter nonce. Frames are uint16 length | ciphertext, and an empty frame marks
+// a clean close so a relay cannot truncate the stream unnoticed.
+type SealedConn struct {
+	net.Conn
+	key      *E2EKey
+	salt     []byte
+	saltErr  error
+	exchange sync.Once
+
+	reader   cipher.AEAD
+	readSeq  uint64
+	readBuf  []byte // Decrypted data not returned yet
+	finished bool
+	rmu      sync.Mutex
+
+	writer   cipher.AEAD
+	writeSeq uint64
+	closed   bool
+	wmu      sync.Mutex
+}
+
+// Seal starts end-to-end encryption on conn. It sends this end's salt right
+// away; the peer's salt is read on first use.
+func Seal(conn net.Conn, key *E2EKey) (*SealedConn, error) {
+	salt := make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(salt); err != nil {
+		return nil, fmt.Errorf("failed to send e2e salt: %w", err)
+	}
+
+	return &SealedConn{Conn: conn, key: key, salt: salt}, nil
+}
+
+// handshake reads the peer's salt and derives the keys for both directions
+func (c *SealedConn) handshake() error {
+	c.exchange.Do(func() {
+		peer := make([]byte, e2eSaltSize)
+		if _, err := io.ReadFull(c.Conn, peer); err != nil {
+			c.saltErr = fmt.Errorf("failed to read e2e salt: %w", err)
+			return
+		}
+
+		// A relay echoing our own salt would give both directions the same key
+		// and could reflect our frames back to us
+		if subtle.ConstantTimeCompare(peer, c.salt) == 1 {
+			c.saltErr = fmt.Errorf("%w: peer sent our own salt", ErrE2EAuth)
+			return
+		}
+
+		writer, err := c.deriveAEAD(c.salt, peer)
+		if err != nil {
+			c.saltErr = err
+			return
+		}
+		if c.reader, c.saltErr = c.deriveAEAD(peer, c.salt); c.saltErr != nil {
+			return
+		}
+
+		// Close checks writer under wmu to decide whether it can send the close marker
+		c.wmu.Lock()
+		c.writer = writer
+		c.wmu.Unlock()
+	})
+	return c.saltErr
+}
+
+// deriveAEAD returns the cipher for data sent by the end that chose senderSalt
+func (c *SealedConn) deriveAEAD(senderSalt, receiverSalt []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, senderSalt...), receiverSalt...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.key.master, salt, []byte(e2eKeySalt)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+func (c *SealedConn) Read(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		if c.finished {
+			return 0, io.EOF
+		}
+
+		lenBuf := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, lenBuf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(lenBuf))
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		plain, err := c.reader.Open(frame[:0], nonce(c.readSeq), frame, nil)
+		if err != nil {
+			return 0, ErrE2EAuth
+		}
+		c.readSeq++
+
+		if len(plain) == 0 {
+			c.finished = true
+		}
+		c.readBuf = plain
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *SealedConn) Write(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), e2eMaxPlaintext)]
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame seals plain and writes it as one frame; must be called with wmu held
+func (c *SealedConn) writeFrame(plain []byte) error {
+	frame := make([]byte, 2, 2+len(plain)+c.writer.Overhead())
+	frame = c.writer.Seal(frame, nonce(c.writeSeq), plain, nil)
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	c.writeSeq++
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends the close marker so the peer reads a clean EOF, then closes the connection
+func (c *SealedConn) Close() error {
+	c.wmu.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.writer != nil {
+			c.writeFrame(nil)
+		}
+	}
+	c.wmu.Unlock()
+
+	return c.Conn.Close()
+}
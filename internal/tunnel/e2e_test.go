@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// bufConn is one end of an in-memory connection. Reads drain in and return
+// io.EOF once it is empty, so a test can run both ends in one goroutine and
+// tamper with the bytes in between.
+type bufConn struct {
+	net.Conn
+	in, out *bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *bufConn) Close() error                { return nil }
+
+// sealedPair returns two sealed ends and the buffers carrying a->b and b->a traffic
+func sealedPair(t *testing.T, keyA, keyB *E2EKey) (a, b *SealedConn, ab, ba *bytes.Buffer) {
+	t.Helper()
+
+	ab, ba = new(bytes.Buffer), new(bytes.Buffer)
+	a, err := Seal(&bufConn{in: ba, out: ab}, keyA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = Seal(&bufConn{in: ab, out: ba}, keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, ab, ba
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSealedConnRoundTrip(t *testing.T) {
+	key := NewE2EKey("secret")
+	a, b, _, _ := sealedPair(t, key, key)
+
+	// Larger than one frame in each direction
+	for _, dir := range []struct {
+		name     string
+		from, to *SealedConn
+	}{{"a to b", a, b}, {"b to a", b, a}} {
+		data := randomBytes(t, 3*e2eMaxPlaintext+123)
+		if _, err := dir.from.Write(data); err != nil {
+			t.Fatalf("%s: write: %v", dir.name, err)
+		}
+
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: read: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: data does not match", dir.name)
+		}
+	}
+}
+
+func TestSealedConnCloseMarker(t *testing.T) {
+	key := NewE2EKey("secret")
+	a, b, _, _ := sealedPair(t, key, key)
+
+	data := randomBytes(t, 1000)
+	if _, err := a.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("read after close marker: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data does not match")
+	}
+}
+
+func TestSealedConnTruncation(t *testing.T) {
+	key := NewE2EKey("secret")
+
+	// The stream ends without the close marker
+	a, b, _, _ := sealedPair(t, key, key)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(got); err != io.ErrUnexpectedEOF {
+		t.Fatalf("missing close marker: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// The stream ends in the middle of a frame
+	a, b, ab, _ := sealedPair(t, key, key)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ab.Truncate(ab.Len() - 3)
+	if _, err := io.ReadAll(b); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestSealedConnTamper(t *testing.T) {
+	key := NewE2EKey("secret")
+	a, b, ab, _ := sealedPair(t, key, key)
+
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ab.Bytes()[ab.Len()-1] ^= 0x01
+
+	if _, err := io.ReadAll(b); !errors.Is(err, ErrE2EAuth) {
+		t.Fatalf("tampered frame: got %v, want %v", err, ErrE2EAuth)
+	}
+}
+
+func TestSealedConnKeyMismatch(t *testing.T) {
+	a, b, _, _ := sealedPair(t, NewE2EKey("secret"), NewE2EKey("other"))
+
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(b); !errors.Is(err, ErrE2EAuth) {
+		t.Fatalf("mismatched keys: got %v, want %v", err, ErrE2EAuth)
+	}
+}
+
+func TestSealedConnReflectedSalt(t *testing.T) {
+	out, in := new(bytes.Buffer), new(bytes.Buffer)
+	a, err := Seal(&bufConn{in: in, out: out}, NewE2EKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A relay sends our own salt back as the peer's
+	in.Write(out.Bytes())
+
+	if _, err := a.Write([]byte("hello")); !errors.Is(err, ErrE2EAuth) {
+		t.Fatalf("reflected salt: got %v, want %v", err, ErrE2EAuth)
+	}
+}
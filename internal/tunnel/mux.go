@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/markCwatson/mgrok/internal/transport"
+	"github.com/xtaci/smux"
+)
+
+// MuxConfig tunes the smux session and the TCP socket under it. Zero values
+// keep the smux defaults; version must be the same on the client and the server.
+type MuxConfig struct {
+	Version           int  `yaml:"version"`            // smux protocol version, 1 (default) or 2
+	KeepAliveDisabled bool `yaml:"keepalive_disabled"` // Stop sending session keepalives
+	KeepAliveInterval int  `yaml:"keepalive_interval"` // Seconds between session keepalives (default 10)
+	KeepAliveTimeout  int  `yaml:"keepalive_timeout"`  // Seconds without data before the session is closed (default 30)
+	MaxFrameSize      int  `yaml:"max_frame_size"`     // Bytes per frame, at most 65535 (default 32768)
+	MaxReceiveBuffer  int  `yaml:"max_receive_buffer"` // Bytes buffered for the whole session (default 4 MiB)
+	MaxStreamBuffer   int  `yaml:"max_stream_buffer"`  // Bytes buffered per stream (default 64 KiB)
+
+	transport.SocketConfig `yaml:",inline"`
+}
+
+// SmuxConfig builds the smux configuration and checks it with smux.VerifyConfig
+func (c *MuxConfig) SmuxConfig() (*smux.Config, error) {
+	cfg := smux.DefaultConfig()
+	if c.Version != 0 {
+		cfg.Version = c.Version
+	}
+	cfg.KeepAliveDisabled = c.KeepAliveDisabled
+	if c.KeepAliveInterval != 0 {
+		cfg.KeepAliveInterval = time.Duration(c.KeepAliveInterval) * time.Second
+	}
+	if c.KeepAliveTimeout != 0 {
+		cfg.KeepAliveTimeout = time.Duration(c.KeepAliveTimeout) * time.Second
+	}
+	if c.MaxFrameSize != 0 {
+		cfg.MaxFrameSize = c.MaxFrameSize
+	}
+	if c.MaxReceiveBuffer != 0 {
+		cfg.MaxReceiveBuffer = c.MaxReceiveBuffer
+	}
+	if c.MaxStreamBuffer != 0 {
+		cfg.MaxStreamBuffer = c.MaxStreamBuffer
+	}
+
+	if err := smux.VerifyConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid mux config: %w", err)
+	}
+	return cfg, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 )
 
 const (
@@ -14,24 +15,70 @@ const (
 	MsgTypeData      = 0x03
 	MsgTypeClose     = 0x04
 	MsgTypeHeartbeat = 0x05
+	MsgTypeStatus    = 0x06
+	MsgTypeVisit     = 0x07
+	MsgTypeForward   = 0x08
+	MsgTypeWorkConn  = 0x09
+	MsgTypeJoin      = 0x0A
+	MsgTypeRegReply  = 0x0B
+	MsgTypeJoinReply = 0x0C
+
+	// Proxy status values
+	StatusHealthy   = 0x00
+	StatusUnhealthy = 0x01
+	StatusRemoved   = 0x02 // Sent by the server: the proxy was unregistered
+
+	// Replies to Register, Join, Visit and Forward requests
+	ReplyOK     = 0x00
+	ReplyDenied = 0x01
+	ReplyFailed = 0x02 // Allowed, but the target could not be reached
+
+	// Join roles: the primary session announces the run ID, further sessions join it
+	JoinPrimary = 0x00
+	JoinMember  = 0x01
 
 	// Proxy types
-	ProxyTypeTCP = 0x01
-	ProxyTypeUDP = 0x02
+	ProxyTypeTCP  = 0x01
+	ProxyTypeUDP  = 0x02
+	ProxyTypeSTCP = 0x03 // secret TCP: no public port, reachable only by visitors
 
 	// Auth methods
 	AuthMethodToken = 0x01
 	AuthMethodmTLS  = 0x02
+
+	// Register option types
+	OptAllowCIDRs = 0x01
+	OptDenyCIDRs  = 0x02
+	OptBandwidth  = 0x03
+	OptMaxConns   = 0x04
+	OptTLSTerm    = 0x05
+	OptGroup      = 0x06
+	OptSecret     = 0x07
+	OptPoolCount  = 0x08
+	OptCompress   = 0x09
+	OptPeerAddr   = 0x0A
+
+	// MaxControlMsgLen is the largest message the control stream can carry
+	MaxControlMsgLen = 0xFFFF
 )
 
-// Updated protocol message formats:
+// Updated protocol message formats. Every message on the control stream,
+// the handshake included, is framed as uint16 length | message.
 //
 // <Handshake> : 4 bytes "GRT1" + uint8 authMethod + authPayload…
-// <Register>   : msgType=0x01 | uint8 proxyType | uint16 remotePort | uint16 localPort | N bytes name
-// <NewStream>  : msgType=0x02 | uint32 streamID | uint16 remotePort | uint8 nameLen | N bytes name
+// <Register>   : msgType=0x01 | uint8 proxyType | uint16 remotePort | uint16 localPort | uint8 nameLen | N bytes name | options…
+// <Option>     : uint8 optType | uint16 length | …bytes…
+// <NewStream>  : msgType=0x02 | uint32 streamID | uint16 remotePort | uint8 nameLen | N bytes name [| uint8 len | peer address]
 // <Data>       : msgType=0x03 | uint32 streamID | uint16 length | …bytes…
 // <Close>      : msgType=0x04 | uint32 streamID
 // <Heartbeat>  : msgType=0x05
+// <Status>     : msgType=0x06 | uint8 status | uint8 nameLen | N bytes name
+// <Visit>      : msgType=0x07 | uint8 nameLen | N bytes name | uint8 secretLen | N bytes secret
+// <Forward>    : msgType=0x08 | uint8 targetLen | N bytes target (host:port)
+// <WorkConn>   : msgType=0x09 | uint8 nameLen | N bytes name
+// <Join>       : msgType=0x0A | uint8 role | uint8 idLen | N bytes run ID
+// <RegReply>   : msgType=0x0B | uint8 reply | uint8 nameLen | name | uint8 len | compression | uint8 len | error
+// <JoinReply>  : msgType=0x0C | uint8 reply | uint8 len | error
 
 // Protocol handshake: 4 bytes "GRT1" + uint8 authMethod + authPayload
 type Handshake struct {
@@ -40,15 +87,41 @@ type Handshake struct {
 	AuthPayload []byte
 }
 
-// Register message: msgType=0x01 | uint8 proxyType | uint16 remotePort | uint16 localPort | N bytes name
+// Register message: msgType=0x01 | uint8 proxyType | uint16 remotePort | uint16 localPort | uint8 nameLen | N bytes name | options…
 type RegisterMsg struct {
 	ProxyType  uint8
 	RemotePort uint16
 	LocalPort  uint16
 	Name       string
+	AllowCIDRs []string // OptAllowCIDRs, comma separated on the wire
+	DenyCIDRs  []string // OptDenyCIDRs, comma separated on the wire
+
+	// OptBandwidth: uint32 bytes per second | uint32 burst bytes
+	BandwidthLimit uint32
+	BandwidthBurst uint32
+
+	MaxConns uint32 // OptMaxConns: uint32 concurrent connections
+
+	// OptTLSTerm: N bytes certificate name (empty selects the server's default certificate)
+	TLSTermination bool
+	TLSCertName    string
+
+	// OptGroup: uint8 len | group | uint8 len | key | uint8 len | strategy
+	Group         string
+	GroupKey      string
+	GroupStrategy string
+
+	Secret string // OptSecret: N bytes secret visitors must present (STCP proxies)
+
+	PoolCount uint32 // OptPoolCount: uint32 streams the client keeps open in advance
+
+	Compression string // OptCompress: N bytes algorithm for data streams after NewStream
+
+	PeerAddr bool // OptPeerAddr: no value; NewStream ends with the public peer's host:port
 }
 
-// NewStream message: msgType=0x02 | uint32 streamID | uint16 remotePort | uint8 nameLen | N bytes name
+// NewStream message: msgType=0x02 | uint32 streamID | uint16 remotePort | uint8 nameLen | N bytes name,
+// followed by uint8 len | peer address for proxies registered with OptPeerAddr
 type NewStreamMsg struct {
 	StreamID   uint32
 	RemotePort uint16
@@ -68,6 +141,19 @@ type CloseMsg struct {
 	StreamID uint32
 }
 
+// Status message: msgType=0x06 | uint8 status | uint8 nameLen | N bytes name
+type StatusMsg struct {
+	Status uint8
+	Name   string
+}
+
+// Visit message: msgType=0x07 | uint8 nameLen | N bytes name | uint8 secretLen | N bytes secret
+// Sent by a visitor on a new stream; the server answers with a single ReplyOK or ReplyDenied byte
+type VisitMsg struct {
+	Name   string
+	Secret string
+}
+
 // WriteHandshake writes a protocol handshake to any io.Writer (such as a control stream)
 func WriteHandshake(w io.Writer, authMethod uint8, authPayload []byte) error {
 	// Create the full handshake message
@@ -80,9 +166,7 @@ func WriteHandshake(w io.Writer, authMethod uint8, authPayload []byte) error {
 		log.Printf("Sending handshake: [% x]", handshake)
 	}
 
-	// Write the full handshake in one call to ensure atomic write
-	_, err := w.Write(handshake)
-	if err != nil {
+	if err := writeControl(w, handshake); err != nil {
 		return fmt.Errorf("failed to write handshake: %w", err)
 	}
 
@@ -90,26 +174,465 @@ func WriteHandshake(w io.Writer, authMethod uint8, authPayload []byte) error {
 }
 
 // WriteRegister writes a register message to any io.Writer (such as a control stream)
-func WriteRegister(w io.Writer, proxyType uint8, remotePort, localPort uint16, name string) error {
-	msgBuf := make([]byte, 0, 10+len(name))
+func WriteRegister(w io.Writer, msg *RegisterMsg) error {
+	if len(msg.Name) == 0 || len(msg.Name) > 255 {
+		return fmt.Errorf("invalid proxy name length: %d", len(msg.Name))
+	}
+
+	msgBuf := make([]byte, 0, 7+len(msg.Name))
 
 	msgBuf = append(msgBuf, MsgTypeRegister)
-	msgBuf = append(msgBuf, proxyType)
+	msgBuf = append(msgBuf, msg.ProxyType)
 	portBuf := make([]byte, 4)
-	binary.BigEndian.PutUint16(portBuf, remotePort)
-	binary.BigEndian.PutUint16(portBuf[2:], localPort)
+	binary.BigEndian.PutUint16(portBuf, msg.RemotePort)
+	binary.BigEndian.PutUint16(portBuf[2:], msg.LocalPort)
 	msgBuf = append(msgBuf, portBuf...)
-	msgBuf = append(msgBuf, []byte(name)...)
+	msgBuf = append(msgBuf, byte(len(msg.Name)))
+	msgBuf = append(msgBuf, []byte(msg.Name)...)
 
-	log.Printf("Sending register message (%d bytes): [% x]", len(msgBuf), msgBuf)
+	// Options are only sent when set; servers skip option types they do not know.
+	// The nameLen byte above changed the format, so older servers cannot parse this.
+	if len(msg.AllowCIDRs) > 0 {
+		msgBuf = appendOption(msgBuf, OptAllowCIDRs, []byte(strings.Join(msg.AllowCIDRs, ",")))
+	}
+	if len(msg.DenyCIDRs) > 0 {
+		msgBuf = appendOption(msgBuf, OptDenyCIDRs, []byte(strings.Join(msg.DenyCIDRs, ",")))
+	}
+	if msg.BandwidthLimit > 0 {
+		bwBuf := make([]byte, 8)
+		binary.BigEndian.PutUint32(bwBuf[0:4], msg.BandwidthLimit)
+		binary.BigEndian.PutUint32(bwBuf[4:8], msg.BandwidthBurst)
+		msgBuf = appendOption(msgBuf, OptBandwidth, bwBuf)
+	}
+	if msg.MaxConns > 0 {
+		connBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(connBuf, msg.MaxConns)
+		msgBuf = appendOption(msgBuf, OptMaxConns, connBuf)
+	}
+	if msg.TLSTermination {
+		msgBuf = appendOption(msgBuf, OptTLSTerm, []byte(msg.TLSCertName))
+	}
+	if msg.Group != "" {
+		value, err := packStrings(msg.Group, msg.GroupKey, msg.GroupStrategy)
+		if err != nil {
+			return fmt.Errorf("invalid group option: %w", err)
+		}
+		msgBuf = appendOption(msgBuf, OptGroup, value)
+	}
+	if msg.Secret != "" {
+		msgBuf = appendOption(msgBuf, OptSecret, []byte(msg.Secret))
+	}
+	if msg.PoolCount > 0 {
+		poolBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(poolBuf, msg.PoolCount)
+		msgBuf = appendOption(msgBuf, OptPoolCount, poolBuf)
+	}
+	if msg.Compression != "" {
+		msgBuf = appendOption(msgBuf, OptCompress, []byte(msg.Compression))
+	}
+	if msg.PeerAddr {
+		msgBuf = appendOption(msgBuf, OptPeerAddr, nil)
+	}
+
+	// Long CIDR lists or secrets could push the message past what one frame holds
+	if len(msgBuf) > MaxControlMsgLen {
+		return fmt.Errorf("register message for proxy %s is %d bytes, the limit is %d",
+			msg.Name, len(msgBuf), MaxControlMsgLen)
+	}
+
+	// Options may carry secrets, so only the fixed header is dumped
+	headerLen := 7 + len(msg.Name)
+	log.Printf("Sending register message (%d bytes): [% x] + options (%d bytes)",
+		len(msgBuf), msgBuf[:headerLen], len(msgBuf)-headerLen)
 	log.Printf("Register details: type=%d, remote=%d, local=%d, name=%s",
-		proxyType, remotePort, localPort, name)
+		msg.ProxyType, msg.RemotePort, msg.LocalPort, msg.Name)
 
-	// Write the full message in one call
-	_, err := w.Write(msgBuf)
-	if err != nil {
+	if err := writeControl(w, msgBuf); err != nil {
 		return fmt.Errorf("failed to write register message: %w", err)
 	}
 
 	return nil
 }
+
+// ParseRegister parses a register message body (everything after the msgType byte)
+func ParseRegister(data []byte) (*RegisterMsg, error) {
+	// proxyType(1) + remotePort(2) + localPort(2) + nameLen(1) + at least 1 byte name
+	if len(data) < 7 {
+		return nil, fmt.Errorf("register message too short: expected at least 7 bytes, got %d", len(data))
+	}
+
+	msg := &RegisterMsg{
+		ProxyType:  data[0],
+		RemotePort: binary.BigEndian.Uint16(data[1:3]),
+		LocalPort:  binary.BigEndian.Uint16(data[3:5]),
+	}
+
+	nameLen := int(data[5])
+	if nameLen == 0 || len(data) < 6+nameLen {
+		return nil, fmt.Errorf("invalid proxy name length: %d", nameLen)
+	}
+	msg.Name = string(data[6 : 6+nameLen])
+
+	opts := data[6+nameLen:]
+	for len(opts) > 0 {
+		if len(opts) < 3 {
+			return nil, fmt.Errorf("truncated register option header")
+		}
+		optType := opts[0]
+		optLen := int(binary.BigEndian.Uint16(opts[1:3]))
+		if len(opts) < 3+optLen {
+			return nil, fmt.Errorf("truncated register option 0x%02x", optType)
+		}
+		value := opts[3 : 3+optLen]
+		opts = opts[3+optLen:]
+
+		switch optType {
+		case OptAllowCIDRs:
+			msg.AllowCIDRs = strings.Split(string(value), ",")
+		case OptDenyCIDRs:
+			msg.DenyCIDRs = strings.Split(string(value), ",")
+		case OptBandwidth:
+			if len(value) != 8 {
+				return nil, fmt.Errorf("invalid bandwidth option length: %d", len(value))
+			}
+			msg.BandwidthLimit = binary.BigEndian.Uint32(value[0:4])
+			msg.BandwidthBurst = binary.BigEndian.Uint32(value[4:8])
+		case OptMaxConns:
+			if len(value) != 4 {
+				return nil, fmt.Errorf("invalid max connections option length: %d", len(value))
+			}
+			msg.MaxConns = binary.BigEndian.Uint32(value)
+		case OptTLSTerm:
+			msg.TLSTermination = true
+			msg.TLSCertName = string(value)
+		case OptGroup:
+			fields, err := unpackStrings(value, 3)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group option: %w", err)
+			}
+			msg.Group, msg.GroupKey, msg.GroupStrategy = fields[0], fields[1], fields[2]
+		case OptSecret:
+			msg.Secret = string(value)
+		case OptPoolCount:
+			if len(value) != 4 {
+				return nil, fmt.Errorf("invalid pool count option length: %d", len(value))
+			}
+			msg.PoolCount = binary.BigEndian.Uint32(value)
+		case OptCompress:
+			msg.Compression = string(value)
+		case OptPeerAddr:
+			msg.PeerAddr = true
+		default:
+			// Unknown options are skipped so newer clients can talk to older servers
+			log.Printf("Ignoring unknown register option 0x%02x", optType)
+		}
+	}
+
+	return msg, nil
+}
+
+// appendOption appends a single register option to buf
+func appendOption(buf []byte, optType uint8, value []byte) []byte {
+	hdr := make([]byte, 3)
+	hdr[0] = optType
+	binary.BigEndian.PutUint16(hdr[1:], uint16(len(value)))
+	buf = append(buf, hdr...)
+	return append(buf, value...)
+}
+
+// packStrings encodes each string with a uint8 length prefix
+func packStrings(fields ...string) ([]byte, error) {
+	var buf []byte
+	for _, f := range fields {
+		if len(f) > 255 {
+			return nil, fmt.Errorf("field too long: %d bytes", len(f))
+		}
+		buf = append(buf, byte(len(f)))
+		buf = append(buf, f...)
+	}
+	return buf, nil
+}
+
+// unpackStrings decodes count uint8 length prefixed strings
+func unpackStrings(buf []byte, count int) ([]string, error) {
+	fields := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+			return nil, fmt.Errorf("truncated field %d", i)
+		}
+		l := int(buf[0])
+		fields = append(fields, string(buf[1:1+l]))
+		buf = buf[1+l:]
+	}
+	return fields, nil
+}
+
+// WriteStatus writes a proxy status message to any io.Writer (such as a control stream)
+func WriteStatus(w io.Writer, name string, status uint8) error {
+	if len(name) == 0 || len(name) > 255 {
+		return fmt.Errorf("invalid proxy name length: %d", len(name))
+	}
+
+	msgBuf := make([]byte, 0, 3+len(name))
+	msgBuf = append(msgBuf, MsgTypeStatus, status, byte(len(name)))
+	msgBuf = append(msgBuf, name...)
+
+	if err := writeControl(w, msgBuf); err != nil {
+		return fmt.Errorf("failed to write status message: %w", err)
+	}
+	return nil
+}
+
+// ParseStatus parses a status message body (everything after the msgType byte)
+func ParseStatus(data []byte) (*StatusMsg, error) {
+	if len(data) < 3 || len(data) < 2+int(data[1]) {
+		return nil, fmt.Errorf("status message too short: %d bytes", len(data))
+	}
+	if len(data) > 2+int(data[1]) {
+		return nil, fmt.Errorf("status message has %d trailing bytes", len(data)-2-int(data[1]))
+	}
+
+	return &StatusMsg{
+		Status: data[0],
+		Name:   string(data[2 : 2+int(data[1])]),
+	}, nil
+}
+
+// Join message: msgType=0x0A | uint8 role | uint8 idLen | N bytes run ID
+type JoinMsg struct {
+	Role  uint8
+	RunID string
+}
+
+// WriteJoin ties the session to a logical client identified by runID (such as on a control stream)
+func WriteJoin(w io.Writer, role uint8, runID string) error {
+	if len(runID) == 0 || len(runID) > 255 {
+		return fmt.Errorf("invalid run ID length: %d", len(runID))
+	}
+
+	msgBuf := make([]byte, 0, 3+len(runID))
+	msgBuf = append(msgBuf, MsgTypeJoin, role, byte(len(runID)))
+	msgBuf = append(msgBuf, runID...)
+
+	if err := writeControl(w, msgBuf); err != nil {
+		return fmt.Errorf("failed to write join message: %w", err)
+	}
+	return nil
+}
+
+// ParseJoin parses a join message body (everything after the msgType byte)
+func ParseJoin(data []byte) (*JoinMsg, error) {
+	if len(data) < 3 || len(data) < 2+int(data[1]) {
+		return nil, fmt.Errorf("join message too short: %d bytes", len(data))
+	}
+	if len(data) > 2+int(data[1]) {
+		return nil, fmt.Errorf("join message has %d trailing bytes", len(data)-2-int(data[1]))
+	}
+
+	return &JoinMsg{
+		Role:  data[0],
+		RunID: string(data[2 : 2+int(data[1])]),
+	}, nil
+}
+
+// Join reply message: the server's answer to each Join
+type JoinReplyMsg struct {
+	Reply uint8  // ReplyOK or ReplyDenied
+	Error string // Why the session was refused
+}
+
+// WriteJoinReply answers a join message (such as on a control stream)
+func WriteJoinReply(w io.Writer, msg *JoinReplyMsg) error {
+	errText := msg.Error
+	if len(errText) > 255 {
+		errText = errText[:255]
+	}
+	body, err := packStrings(errText)
+	if err != nil {
+		return fmt.Errorf("invalid join reply: %w", err)
+	}
+
+	if err := writeControl(w, append([]byte{MsgTypeJoinReply, msg.Reply}, body...)); err != nil {
+		return fmt.Errorf("failed to write join reply: %w", err)
+	}
+	return nil
+}
+
+// ReadJoinReply reads a join reply from a control stream
+func ReadJoinReply(r io.Reader) (*JoinReplyMsg, error) {
+	msg, err := ReadControl(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read join reply: %w", err)
+	}
+	if msg[0] != MsgTypeJoinReply || len(msg) < 2 {
+		return nil, fmt.Errorf("expected join reply, got message type 0x%02x", msg[0])
+	}
+
+	fields, err := unpackStrings(msg[2:], 1)
+	if err != nil {
+		return nil, fmt.Errorf("invalid join reply: %w", err)
+	}
+	return &JoinReplyMsg{Reply: msg[1], Error: fields[0]}, nil
+}
+
+// Register reply message: the server's answer to each Register
+type RegisterReplyMsg struct {
+	Reply       uint8  // ReplyOK or ReplyDenied
+	Name        string // Proxy the reply is for
+	Compression string // Algorithm the server applies to data streams (empty means none)
+	Error       string // Why the proxy was refused
+}
+
+// WriteRegisterReply answers a register message (such as on a control stream)
+func WriteRegisterReply(w io.Writer, msg *RegisterReplyMsg) error {
+	errText := msg.Error
+	if len(errText) > 255 {
+		errText = errText[:255]
+	}
+	body, err := packStrings(msg.Name, msg.Compression, errText)
+	if err != nil {
+		return fmt.Errorf("invalid register reply: %w", err)
+	}
+
+	if err := writeControl(w, append([]byte{MsgTypeRegReply, msg.Reply}, body...)); err != nil {
+		return fmt.Errorf("failed to write register reply: %w", err)
+	}
+	return nil
+}
+
+// ParseRegisterReply parses a register reply body (everything after the msgType byte)
+func ParseRegisterReply(data []byte) (*RegisterReplyMsg, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("register reply too short")
+	}
+
+	fields, err := unpackStrings(data[1:], 3)
+	if err != nil {
+		return nil, fmt.Errorf("invalid register reply: %w", err)
+	}
+	return &RegisterReplyMsg{Reply: data[0], Name: fields[0], Compression: fields[1], Error: fields[2]}, nil
+}
+
+// WriteHeartbeat writes a heartbeat message to a control stream
+func WriteHeartbeat(w io.Writer) error {
+	return writeControl(w, []byte{MsgTypeHeartbeat})
+}
+
+// writeControl frames a control message with its length and writes it in one call
+func writeControl(w io.Writer, msg []byte) error {
+	if len(msg) == 0 || len(msg) > MaxControlMsgLen {
+		return fmt.Errorf("invalid control message length: %d", len(msg))
+	}
+
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// ReadControl reads one framed message from a control stream
+func ReadControl(r io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint16(lenBuf)
+	if msgLen == 0 {
+		return nil, fmt.Errorf("empty control message")
+	}
+
+	msg := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteVisit writes a visit message to any io.Writer (such as a new stream)
+func WriteVisit(w io.Writer, name, secret string) error {
+	body, err := packStrings(name, secret)
+	if err != nil {
+		return fmt.Errorf("invalid visit message: %w", err)
+	}
+
+	if _, err := w.Write(append([]byte{MsgTypeVisit}, body...)); err != nil {
+		return fmt.Errorf("failed to write visit message: %w", err)
+	}
+	return nil
+}
+
+// ReadVisit reads a visit message body (everything after the msgType byte)
+func ReadVisit(r io.Reader) (*VisitMsg, error) {
+	fields, err := readStrings(r, 2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read visit message: %w", err)
+	}
+
+	return &VisitMsg{Name: fields[0], Secret: fields[1]}, nil
+}
+
+// WriteForward asks the server to dial target (host:port) and relay the stream to it.
+// The server answers with a single ReplyOK, ReplyDenied or ReplyFailed byte.
+func WriteForward(w io.Writer, target string) error {
+	body, err := packStrings(target)
+	if err != nil {
+		return fmt.Errorf("invalid forward message: %w", err)
+	}
+
+	if _, err := w.Write(append([]byte{MsgTypeForward}, body...)); err != nil {
+		return fmt.Errorf("failed to write forward message: %w", err)
+	}
+	return nil
+}
+
+// ReadForward reads a forward message body (everything after the msgType byte) and returns the target
+func ReadForward(r io.Reader) (string, error) {
+	fields, err := readStrings(r, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read forward message: %w", err)
+	}
+	return fields[0], nil
+}
+
+// WriteWorkConn offers a pre-opened stream to the server for the named proxy.
+// The server later starts a NewStream on it, exactly as on a stream it opened itself.
+func WriteWorkConn(w io.Writer, name string) error {
+	body, err := packStrings(name)
+	if err != nil {
+		return fmt.Errorf("invalid work connection message: %w", err)
+	}
+
+	if _, err := w.Write(append([]byte{MsgTypeWorkConn}, body...)); err != nil {
+		return fmt.Errorf("failed to write work connection message: %w", err)
+	}
+	return nil
+}
+
+// ReadWorkConn reads a work connection message body (everything after the msgType byte) and returns the proxy name
+func ReadWorkConn(r io.Reader) (string, error) {
+	fields, err := readStrings(r, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read work connection message: %w", err)
+	}
+	return fields[0], nil
+}
+
+// readStrings reads count length-prefixed strings written by packStrings from a stream
+func readStrings(r io.Reader, count int) ([]string, error) {
+	fields := make([]string, count)
+	lenBuf := make([]byte, 1)
+	for i := range fields {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return nil, err
+		}
+		field := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, err
+		}
+		fields[i] = string(field)
+	}
+	return fields, nil
+}
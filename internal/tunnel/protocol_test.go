@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestControlMessagesKeepTheirBoundaries(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteStatus(&buf, "web", StatusUnhealthy); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteStatus(&buf, "web", StatusHealthy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both messages arrive in one read, as they may on a busy control stream
+	for _, want := range []uint8{StatusUnhealthy, StatusHealthy} {
+		msg, err := ReadControl(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg[0] != MsgTypeStatus {
+			t.Fatalf("got message type 0x%02x, want 0x%02x", msg[0], MsgTypeStatus)
+		}
+		status, err := ParseStatus(msg[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Status != want || status.Name != "web" {
+			t.Fatalf("got status %d for %q, want %d for %q", status.Status, status.Name, want, "web")
+		}
+	}
+}
+
+func TestRegisterRoundTrip(t *testing.T) {
+	var allow []string
+	for i := 0; i < 1000; i++ {
+		allow = append(allow, "10.0.0.0/8")
+	}
+	want := &RegisterMsg{
+		ProxyType:  ProxyTypeTCP,
+		RemotePort: 8080,
+		LocalPort:  3000,
+		Name:       "web",
+		AllowCIDRs: allow, // Far larger than a single read used to hold
+		Group:      "web",
+		GroupKey:   "key",
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRegister(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadControl(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseRegister(msg[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != want.Name || len(got.AllowCIDRs) != len(allow) || got.GroupKey != want.GroupKey {
+		t.Fatalf("register message did not survive the round trip: %+v", got)
+	}
+}
+
+func TestRegisterTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteRegister(&buf, &RegisterMsg{
+		ProxyType: ProxyTypeTCP,
+		Name:      "web",
+		Secret:    strings.Repeat("x", MaxControlMsgLen),
+	})
+	if err == nil {
+		t.Fatal("oversized register message was accepted")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("oversized register message wrote %d bytes", buf.Len())
+	}
+}